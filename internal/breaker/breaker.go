@@ -0,0 +1,230 @@
+package breaker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	wbfredis "github.com/wb-go/wbf/redis"
+	"notifier/internal/models"
+)
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 30 * time.Second
+
+	// Breakers of destinations nobody sends to any more are forgotten.
+	stateTTL = 24 * time.Hour
+
+	indexKey = "breakers"
+)
+
+// allowScript returns how many milliseconds to wait before sending, or 0.
+// An open breaker turns half-open once its timeout has passed and then lets
+// a single probe through at a time; everything else waits for the probe.
+var allowScript = redis.NewScript(`
+local now = redis.call('TIME')
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local timeout = tonumber(ARGV[1])
+local state = redis.call('HMGET', KEYS[1], 'state', 'opened_at', 'probe_until')
+
+if state[1] == 'open' then
+	local reopen = tonumber(state[2]) + timeout
+	if nowMs < reopen then
+		return reopen - nowMs
+	end
+	redis.call('HSET', KEYS[1], 'state', 'half_open', 'probe_until', nowMs + timeout)
+	return 0
+end
+
+if state[1] == 'half_open' then
+	local probeUntil = tonumber(state[3]) or 0
+	if nowMs < probeUntil then
+		return probeUntil - nowMs
+	end
+	redis.call('HSET', KEYS[1], 'probe_until', nowMs + timeout)
+	return 0
+end
+
+return 0
+`)
+
+// recordScript applies the outcome of a send and returns the state before
+// and after it. Consecutive failures open a closed breaker, any failure
+// reopens a half-open one and any success closes it.
+var recordScript = redis.NewScript(`
+local now = redis.call('TIME')
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'state', 'failures')
+local before = state[1] or 'closed'
+local failures = tonumber(state[2]) or 0
+
+if ARGV[1] == '1' and before == 'closed' and failures == 0 then
+	return {before, 'closed'}
+end
+redis.call('SADD', KEYS[2], ARGV[3])
+
+if ARGV[1] == '1' then
+	redis.call('HSET', KEYS[1], 'state', 'closed', 'failures', 0)
+	redis.call('HDEL', KEYS[1], 'opened_at', 'probe_until')
+	redis.call('PEXPIRE', KEYS[1], ARGV[4])
+	return {before, 'closed'}
+end
+
+failures = failures + 1
+local after = before
+if before == 'half_open' or (before == 'closed' and failures >= tonumber(ARGV[2])) then
+	after = 'open'
+	redis.call('HSET', KEYS[1], 'opened_at', nowMs)
+	redis.call('HDEL', KEYS[1], 'probe_until')
+end
+redis.call('HSET', KEYS[1], 'state', after, 'failures', failures)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {before, after}
+`)
+
+// Config holds the number of consecutive failures that opens a breaker and
+// how long it stays open before a probe is let through.
+type Config struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+func (c Config) Validate() error {
+	if c.FailureThreshold < 1 {
+		return fmt.Errorf("breaker failure threshold must be at least 1, got %d", c.FailureThreshold)
+	}
+	if c.OpenTimeout <= 0 {
+		return fmt.Errorf("breaker open timeout must be positive, got %s", c.OpenTimeout)
+	}
+	return nil
+}
+
+// State is a breaker as reported by the API.
+type State struct {
+	Key      string     `json:"key"`
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+	RetryAt  *time.Time `json:"retry_at,omitempty"`
+}
+
+// Registry keeps one circuit breaker per channel and destination host in
+// Redis, so every worker replica stops sending to a failing destination as
+// soon as one of them has seen it fail.
+type Registry struct {
+	client *redis.Client
+	config Config
+}
+
+func NewRegistry(addr string, config Config) *Registry {
+	return &Registry{
+		client: wbfredis.New(addr, "", 0).Client,
+		config: config,
+	}
+}
+
+// Key identifies the destination of a notification: the channel plus the
+// host of a URL recipient or the domain of an email address. Other
+// recipients, such as chat IDs, share their channel's breaker.
+func Key(notification *models.Notification) string {
+	recipient := notification.Recipient
+	if u, err := url.Parse(recipient); err == nil && u.Host != "" {
+		return notification.Channel + ":" + strings.ToLower(u.Hostname())
+	}
+	if i := strings.LastIndex(recipient, "@"); i >= 0 && i < len(recipient)-1 {
+		return notification.Channel + ":" + strings.ToLower(recipient[i+1:])
+	}
+	return notification.Channel
+}
+
+func stateKey(key string) string {
+	return "breaker:" + key
+}
+
+// Allow reports how long to hold off sending to key. A zero duration means
+// the breaker is closed or the caller holds the half-open probe.
+func (r *Registry) Allow(ctx context.Context, key string) (time.Duration, error) {
+	wait, err := allowScript.Run(ctx, r.client, []string{stateKey(key)},
+		r.config.OpenTimeout.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to check circuit breaker %s: %w", key, err)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
+
+// Record feeds the outcome of a send to key's breaker.
+func (r *Registry) Record(ctx context.Context, key string, success bool) error {
+	outcome := "0"
+	if success {
+		outcome = "1"
+	}
+
+	result, err := recordScript.Run(ctx, r.client, []string{stateKey(key), indexKey},
+		outcome, r.config.FailureThreshold, key, stateTTL.Milliseconds(),
+	).StringSlice()
+	if err != nil {
+		return fmt.Errorf("failed to record circuit breaker %s: %w", key, err)
+	}
+
+	if before, after := result[0], result[1]; before != after {
+		slog.InfoContext(ctx, "Circuit breaker changed state", "breaker", key, "from", before, "to", after)
+	}
+	return nil
+}
+
+// States lists every known breaker. An open breaker whose timeout has passed
+// is reported as half-open, since the next send will probe it.
+func (r *Registry) States(ctx context.Context) ([]State, error) {
+	keys, err := r.client.SMembers(ctx, indexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list circuit breakers: %w", err)
+	}
+	sort.Strings(keys)
+
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HGetAll(ctx, stateKey(key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get circuit breakers: %w", err)
+	}
+
+	now := time.Now()
+	states := make([]State, 0, len(keys))
+	for i, key := range keys {
+		fields := cmds[i].Val()
+		if len(fields) == 0 {
+			r.client.SRem(ctx, indexKey, key)
+			continue
+		}
+
+		state := State{Key: key, State: fields["state"]}
+		state.Failures, _ = strconv.Atoi(fields["failures"])
+		if ms, err := strconv.ParseInt(fields["opened_at"], 10, 64); err == nil {
+			openedAt := time.UnixMilli(ms)
+			retryAt := openedAt.Add(r.config.OpenTimeout)
+			state.OpenedAt = &openedAt
+			state.RetryAt = &retryAt
+			if state.State == StateOpen && !now.Before(retryAt) {
+				state.State = StateHalfOpen
+			}
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
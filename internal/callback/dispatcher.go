@@ -0,0 +1,392 @@
+package callback
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"notifier/internal/leader"
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/retrypolicy"
+	"notifier/internal/storage"
+	"notifier/internal/tenant"
+)
+
+const (
+	batchSize    = 50
+	claimLease   = 2 * time.Minute
+	pollInterval = time.Second
+
+	requestTimeout = 10 * time.Second
+	maxAttempts    = 12
+)
+
+// backoff spreads the retries of a failing target over up to two and a half
+// hours.
+var backoff = retrypolicy.Policy{
+	Name:       "callback",
+	Kind:       retrypolicy.KindExponential,
+	Base:       5 * time.Second,
+	Multiplier: 2,
+	MaxDelay:   time.Hour,
+	Jitter:     retrypolicy.JitterFull,
+}
+
+// Subscriptions holds the tenant-level callback URLs and the secrets used to
+// sign callbacks for each tenant.
+type Subscriptions struct {
+	urls          map[string]string
+	secrets       map[string]string
+	defaultSecret string
+}
+
+// NewSubscriptions parses the tenant subscriptions ("tenant=url" entries),
+// which receive every final status change of the tenant's notifications, and
+// the signing secrets ("tenant=secret" entries) with defaultSecret as the
+// fallback. Callbacks are always signed, so every subscribed tenant needs a
+// secret.
+func NewSubscriptions(defaultSecret string, secrets, subscriptions []string) (Subscriptions, error) {
+	s := Subscriptions{
+		urls:          make(map[string]string),
+		secrets:       make(map[string]string),
+		defaultSecret: defaultSecret,
+	}
+
+	for _, entry := range subscriptions {
+		id, target, ok := strings.Cut(entry, "=")
+		if !ok {
+			return Subscriptions{}, fmt.Errorf("invalid callback subscription %q", entry)
+		}
+		if err := ValidateURL(target); err != nil {
+			return Subscriptions{}, fmt.Errorf("invalid callback subscription %q: %w", entry, err)
+		}
+		s.urls[id] = target
+	}
+
+	for _, entry := range secrets {
+		id, secret, ok := strings.Cut(entry, "=")
+		if !ok || secret == "" {
+			return Subscriptions{}, fmt.Errorf("invalid callback secret entry for %q", id)
+		}
+		s.secrets[id] = secret
+	}
+
+	for id := range s.urls {
+		if !s.Enabled(id) {
+			return Subscriptions{}, fmt.Errorf("callback subscription for %s has no signing secret", id)
+		}
+	}
+
+	return s, nil
+}
+
+// Enabled reports whether the tenant has a secret to sign callbacks with;
+// without one no callbacks are sent.
+func (s Subscriptions) Enabled(tenantID string) bool {
+	return s.secret(tenantID) != ""
+}
+
+func (s Subscriptions) secret(tenantID string) string {
+	if secret, ok := s.secrets[tenantID]; ok {
+		return secret
+	}
+	return s.defaultSecret
+}
+
+// ValidateURL accepts absolute http and https URLs, except those naming a
+// loopback, link-local or private address. Host names are only checked when
+// the callback is sent, since what they resolve to can change until then.
+func ValidateURL(target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback URL must be an absolute http or https URL")
+	}
+
+	host := u.Hostname()
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return errForbiddenAddress
+	}
+	if addr, err := netip.ParseAddr(host); err == nil && forbidden(addr) {
+		return errForbiddenAddress
+	}
+	return nil
+}
+
+var errForbiddenAddress = errors.New("callback URL must not point to a loopback, link-local or private address")
+
+// forbidden reports whether callbacks must not reach addr, so that callback
+// URLs cannot be used to reach the worker's own network.
+func forbidden(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast()
+}
+
+// newClient returns a client that checks every address it connects to,
+// including after redirects and DNS changes since ValidateURL. It never uses
+// a proxy, which would hide the target's address.
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: requestTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if forbidden(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errForbiddenAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: requestTimeout, Transport: transport}
+}
+
+// Event is the body POSTed to callback targets. ID stays the same across
+// retries, so receivers can drop duplicates.
+type Event struct {
+	ID             string                    `json:"id"`
+	Type           string                    `json:"type"`
+	TenantID       string                    `json:"tenant_id"`
+	NotificationID string                    `json:"notification_id"`
+	Status         models.NotificationStatus `json:"status"`
+	OccurredAt     time.Time                 `json:"occurred_at"`
+	Notification   *models.Notification      `json:"notification,omitempty"`
+}
+
+// Dispatcher POSTs the callback entries written by storage to the
+// notification's callback URL and its tenant's subscription. Every request
+// carries X-Notifier-Timestamp and X-Notifier-Signature: "sha256=" followed
+// by the hex HMAC-SHA256 of the timestamp, a dot and the body. Entries of
+// tenants without a secret are dropped unsent. Failed targets are retried with backoff
+// until maxAttempts, then dropped. Only the replica holding the coordinator's
+// lock dispatches.
+type Dispatcher struct {
+	storage       storage.Storage
+	subscriptions Subscriptions
+	coordinator   *leader.Coordinator
+	client        *http.Client
+	stopChan      chan struct{}
+	done          chan struct{}
+}
+
+// NewDispatcher dispatches while coordinator, which the caller starts and
+// stops, holds its lock.
+func NewDispatcher(storage storage.Storage, subscriptions Subscriptions, coordinator *leader.Coordinator) *Dispatcher {
+	return &Dispatcher{
+		storage:       storage,
+		subscriptions: subscriptions,
+		coordinator:   coordinator,
+		client:        newClient(),
+		stopChan:      make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (d *Dispatcher) Start(ctx context.Context) {
+	go d.run(ctx)
+	slog.Info("Callback dispatcher started")
+}
+
+// Stop waits for the batch being delivered to finish.
+func (d *Dispatcher) Stop() {
+	close(d.stopChan)
+	<-d.done
+	slog.Info("Callback dispatcher stopped")
+}
+
+func (d *Dispatcher) run(ctx context.Context) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.dispatch(ctx)
+		case <-d.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	if !d.coordinator.Confirm(ctx) {
+		return
+	}
+
+	for {
+		entries, err := d.storage.ClaimCallbacks(ctx, batchSize, claimLease)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming callback entries", logging.KeyError, err)
+			return
+		}
+
+		// Entries are delivered in parallel so that one slow target cannot
+		// hold the batch past its lease.
+		var wg sync.WaitGroup
+		for _, entry := range entries {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.deliver(ctx, entry)
+			}()
+		}
+		wg.Wait()
+
+		if len(entries) < batchSize {
+			return
+		}
+		select {
+		case <-d.stopChan:
+			return
+		default:
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, entry *models.CallbackEntry) {
+	ctx = logging.With(ctx,
+		slog.String("callback_id", entry.ID),
+		slog.String(logging.KeyNotificationID, entry.NotificationID),
+		slog.String(logging.KeyTenant, entry.TenantID),
+	)
+
+	notification, err := d.storage.GetByID(tenant.WithTenant(ctx, entry.TenantID), entry.NotificationID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting notification", logging.KeyError, err)
+		return
+	}
+
+	if !d.subscriptions.Enabled(entry.TenantID) {
+		slog.WarnContext(ctx, "Dropping callback, tenant has no signing secret")
+		d.complete(ctx, entry)
+		return
+	}
+
+	if entry.Attempts == 0 {
+		entry.Targets = d.targets(entry.TenantID, notification)
+	}
+	if len(entry.Targets) == 0 {
+		d.complete(ctx, entry)
+		return
+	}
+
+	body, err := json.Marshal(Event{
+		ID:             entry.ID,
+		Type:           "notification." + string(entry.Status),
+		TenantID:       entry.TenantID,
+		NotificationID: entry.NotificationID,
+		Status:         entry.Status,
+		OccurredAt:     entry.OccurredAt,
+		Notification:   notification,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal callback", logging.KeyError, err)
+		d.complete(ctx, entry)
+		return
+	}
+
+	entry.Attempts++
+	var failed []string
+	for _, target := range entry.Targets {
+		if err := d.post(ctx, target, entry, body); err != nil {
+			slog.WarnContext(ctx, "Callback failed", "target", target, logging.KeyAttempt, entry.Attempts, logging.KeyError, err)
+			failed = append(failed, target)
+		}
+	}
+	entry.Targets = failed
+
+	if len(failed) == 0 {
+		d.complete(ctx, entry)
+		return
+	}
+	if entry.Attempts >= maxAttempts {
+		slog.WarnContext(ctx, "Giving up on callback", logging.KeyAttempt, entry.Attempts)
+		d.complete(ctx, entry)
+		return
+	}
+
+	next := time.Now().Add(backoff.Delay(entry.Attempts, 0))
+	if err := d.storage.RetryCallback(ctx, entry, next); err != nil {
+		slog.ErrorContext(ctx, "Failed to reschedule callback", logging.KeyError, err)
+	}
+}
+
+func (d *Dispatcher) targets(tenantID string, notification *models.Notification) []string {
+	var targets []string
+	if notification != nil && notification.CallbackURL != "" {
+		targets = append(targets, notification.CallbackURL)
+	}
+	if subscription, ok := d.subscriptions.urls[tenantID]; ok && (len(targets) == 0 || targets[0] != subscription) {
+		targets = append(targets, subscription)
+	}
+	return targets
+}
+
+func (d *Dispatcher) post(ctx context.Context, target string, entry *models.CallbackEntry, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Notifier-Event", entry.ID)
+	req.Header.Set("X-Notifier-Timestamp", timestamp)
+	req.Header.Set("X-Notifier-Signature", "sha256="+Sign(d.subscriptions.secret(entry.TenantID), timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *Dispatcher) complete(ctx context.Context, entry *models.CallbackEntry) {
+	if err := d.storage.CompleteCallback(ctx, entry.ID); err != nil {
+		slog.ErrorContext(ctx, "Failed to complete callback", logging.KeyError, err)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 that receivers recompute to verify a
+// callback.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"notifier/internal/logging"
+)
+
+// Watcher reloads the configuration on SIGHUP and, when the file's
+// modification time changes, every reload interval. Each valid reload is
+// handed to the OnReload callbacks, which should only apply the values that
+// are safe to change at runtime; a change to anything else is logged as
+// needing a restart. An invalid configuration is logged and ignored.
+type Watcher struct {
+	loader    *Loader
+	started   *Config
+	callbacks []func(*Config)
+	stopChan  chan struct{}
+	done      chan struct{}
+}
+
+// NewWatcher watches the configuration the process started with.
+func NewWatcher(loader *Loader, started *Config) *Watcher {
+	return &Watcher{
+		loader:   loader,
+		started:  started,
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// OnReload adds a callback, called from the watcher's goroutine. Callbacks
+// are added before Start.
+func (w *Watcher) OnReload(callback func(*Config)) {
+	w.callbacks = append(w.callbacks, callback)
+}
+
+// Start handles SIGHUP from the moment it returns, so a hangup no longer
+// terminates the process.
+func (w *Watcher) Start(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go w.run(ctx, hangup)
+}
+
+func (w *Watcher) Stop() {
+	close(w.stopChan)
+	<-w.done
+}
+
+func (w *Watcher) run(ctx context.Context, hangup chan os.Signal) {
+	defer close(w.done)
+	defer signal.Stop(hangup)
+
+	var poll <-chan time.Time
+	modified := w.modTime()
+	if w.loader.File() != "" && w.started.ReloadInterval > 0 {
+		ticker := time.NewTicker(w.started.ReloadInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-hangup:
+			modified = w.modTime()
+			w.reload(ctx)
+		case <-poll:
+			if t := w.modTime(); !t.Equal(modified) {
+				modified = t
+				w.reload(ctx)
+			}
+		case <-w.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) modTime() time.Time {
+	if w.loader.File() == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(w.loader.File())
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (w *Watcher) reload(ctx context.Context) {
+	next, err := w.loader.Load()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to reload configuration, keeping the current one", logging.KeyError, err)
+		return
+	}
+
+	if w.started.RestartRequired(next) {
+		slog.WarnContext(ctx, "Configuration changed beyond rate limits, tenant quotas and log level; restart to apply it")
+	}
+	for _, callback := range w.callbacks {
+		callback(next)
+	}
+	slog.InfoContext(ctx, "Configuration reloaded", "file", w.loader.File())
+}
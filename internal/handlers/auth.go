@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"notifier/internal/tenant"
+)
+
+type keyIDKey struct{}
+
+// Authenticate resolves the caller's tenant from the X-API-Key header, a
+// Bearer token (or the api_key query parameter for clients that cannot set
+// headers), and records which key it was for the notification history.
+func Authenticate(registry *tenant.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := apiKey(r)
+			if !ok {
+				http.Error(w, "Unsupported authorization scheme", http.StatusUnauthorized)
+				return
+			}
+			tenantID, ok := registry.Lookup(key)
+			if !ok {
+				http.Error(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := tenant.WithTenant(r.Context(), tenantID)
+			if registry.AuthRequired() {
+				ctx = context.WithValue(ctx, keyIDKey{}, keyID(key))
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// keyID names an API key without revealing it: the start of its SHA-256.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:6])
+}
+
+// RequireAdmin only lets callers with an admin key through, for endpoints
+// that expose data of every tenant.
+func RequireAdmin(registry *tenant.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, ok := apiKey(r)
+			if !ok {
+				http.Error(w, "Unsupported authorization scheme", http.StatusUnauthorized)
+				return
+			}
+			if !registry.IsAdmin(key) {
+				http.Error(w, "Admin API key required", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiKey reads the key from the X-API-Key header, a Bearer Authorization
+// header or the api_key query parameter. It reports false for an
+// Authorization header with any other scheme.
+func apiKey(r *http.Request) (string, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, true
+	}
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, key, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return "", false
+		}
+		return strings.TrimSpace(key), true
+	}
+	return r.URL.Query().Get("api_key"), true
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"notifier/internal/tenant"
+)
+
+func TestAuthenticateAuthorizationSchemes(t *testing.T) {
+	registry := tenant.NewRegistry(tenant.Config{Keys: map[string]string{"secret": "acme"}})
+
+	var gotTenant string
+	handler := Authenticate(registry)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotTenant = tenant.FromContext(r.Context())
+	}))
+
+	tests := []struct {
+		authorization string
+		want          int
+	}{
+		{authorization: "Bearer secret", want: http.StatusOK},
+		{authorization: "bearer secret", want: http.StatusOK},
+		{authorization: "BEARER secret", want: http.StatusOK},
+		{authorization: "Bearer wrong", want: http.StatusUnauthorized},
+		{authorization: "Basic secret", want: http.StatusUnauthorized},
+		{authorization: "Token secret", want: http.StatusUnauthorized},
+		{authorization: "secret", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		gotTenant = ""
+		req := httptest.NewRequest(http.MethodGet, "/notify", nil)
+		req.Header.Set("Authorization", tt.authorization)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("Authorization %q: status = %d, want %d", tt.authorization, rec.Code, tt.want)
+		}
+		if tt.want == http.StatusOK && gotTenant != "acme" {
+			t.Errorf("Authorization %q: tenant = %q, want acme", tt.authorization, gotTenant)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"notifier/internal/breaker"
+)
+
+type BreakerHandler struct {
+	breakers *breaker.Registry
+}
+
+func NewBreakerHandler(breakers *breaker.Registry) *BreakerHandler {
+	return &BreakerHandler{
+		breakers: breakers,
+	}
+}
+
+func (h *BreakerHandler) ListBreakers(w http.ResponseWriter, r *http.Request) {
+	states, err := h.breakers.States(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to get circuit breakers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
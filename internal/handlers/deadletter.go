@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"notifier/internal/queue"
+	"notifier/internal/tenant"
+)
+
+type DeadLetterHandler struct {
+	queue queue.DeadLetters
+}
+
+func NewDeadLetterHandler(queue queue.DeadLetters) *DeadLetterHandler {
+	return &DeadLetterHandler{
+		queue: queue,
+	}
+}
+
+func (h *DeadLetterHandler) ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	letters, err := h.queue.ListDeadLetters(ctx, tenant.FromContext(ctx), limit)
+	if err != nil {
+		http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letters)
+}
+
+func (h *DeadLetterHandler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+
+	letter, err := h.queue.GetDeadLetter(ctx, tenant.FromContext(ctx), id)
+	if err != nil {
+		http.Error(w, "Failed to get dead letter", http.StatusInternalServerError)
+		return
+	}
+
+	if letter == nil {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(letter)
+}
+
+func (h *DeadLetterHandler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+
+	replayed, err := h.queue.ReplayDeadLetter(ctx, tenant.FromContext(ctx), id)
+	if err != nil {
+		http.Error(w, "Failed to replay dead letter", http.StatusInternalServerError)
+		return
+	}
+
+	if !replayed {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *DeadLetterHandler) PurgeDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	purged, err := h.queue.PurgeDeadLetters(ctx, tenant.FromContext(ctx))
+	if err != nil {
+		http.Error(w, "Failed to purge dead letters", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
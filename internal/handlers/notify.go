@@ -1,25 +1,47 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"notifier/internal/callback"
+	"notifier/internal/logging"
+	"notifier/internal/metrics"
 	"notifier/internal/models"
-	"notifier/internal/queue"
+	"notifier/internal/outbox"
+	"notifier/internal/quota"
+	"notifier/internal/retrypolicy"
 	"notifier/internal/storage"
+	"notifier/internal/tenant"
+	"notifier/internal/window"
 )
 
 type NotifyHandler struct {
-	storage storage.Storage
-	queue   *queue.Manager
+	storage   storage.Storage
+	relay     *outbox.Relay
+	quota     *quota.Enforcer
+	policies  *retrypolicy.Registry
+	callbacks callback.Subscriptions
+
+	defaultMaxDelay time.Duration
 }
 
-func NewNotifyHandler(storage storage.Storage, queue *queue.Manager) *NotifyHandler {
+func NewNotifyHandler(storage storage.Storage, relay *outbox.Relay, quota *quota.Enforcer, policies *retrypolicy.Registry,
+	callbacks callback.Subscriptions, defaultMaxDelay time.Duration) *NotifyHandler {
 	return &NotifyHandler{
-		storage: storage,
-		queue:   queue,
+		storage:         storage,
+		relay:           relay,
+		quota:           quota,
+		policies:        policies,
+		callbacks:       callbacks,
+		defaultMaxDelay: defaultMaxDelay,
 	}
 }
 
@@ -36,6 +58,68 @@ func (h *NotifyHandler) CreateNotification(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	priority := req.Priority
+	if priority == "" {
+		priority = models.PriorityNormal
+	}
+	if !priority.Valid() {
+		http.Error(w, "Invalid priority", http.StatusBadRequest)
+		return
+	}
+
+	if req.CallbackURL != "" {
+		if !h.callbacks.Enabled(tenant.FromContext(ctx)) {
+			http.Error(w, "Callbacks are not enabled: no signing secret is configured", http.StatusBadRequest)
+			return
+		}
+		if err := callback.ValidateURL(req.CallbackURL); err != nil {
+			http.Error(w, "Invalid callback URL", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.RetryPolicy != "" && !h.policies.Has(req.RetryPolicy) {
+		http.Error(w, "Unknown retry policy", http.StatusBadRequest)
+		return
+	}
+
+	sendAt := req.SendAt
+	if sendAt.Before(time.Now()) {
+		sendAt = time.Now()
+	}
+
+	effectiveSendAt, err := window.Next(req.DeliveryWindow, sendAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expiresAt, err := h.expiresAt(&req, sendAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if expiresAt != nil && !expiresAt.After(effectiveSendAt) {
+		http.Error(w, "Notification would expire before it can be sent", http.StatusBadRequest)
+		return
+	}
+
+	refundQuota, err := h.quota.CheckCreate(ctx)
+	if err != nil {
+		if errors.Is(err, quota.ErrPendingExceeded) || errors.Is(err, quota.ErrRateExceeded) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		slog.ErrorContext(ctx, "Failed to check quota", logging.KeyError, err)
+		http.Error(w, "Failed to check quota", http.StatusInternalServerError)
+		return
+	}
+
+	channel := req.Channel
+	if channel == "" {
+		channel = models.DefaultChannel
+	}
+
 	maxRetries := req.MaxRetries
 	if maxRetries == 0 {
 		maxRetries = 3
@@ -43,25 +127,45 @@ func (h *NotifyHandler) CreateNotification(w http.ResponseWriter, r *http.Reques
 
 	notification := &models.Notification{
 		ID:         generateID(),
+		TenantID:   tenant.FromContext(ctx),
+		Channel:    channel,
+		Recipient:  req.Recipient,
+		Priority:   priority,
 		Message:    req.Message,
-		SendAt:     req.SendAt,
+		SendAt:     sendAt,
 		Status:     models.StatusPending,
 		CreatedAt:  time.Now(),
 		UpdatedAt:  time.Now(),
 		Attempts:   0,
 		MaxRetries: maxRetries,
 		NextRetry:  nil,
+
+		DeliveryWindow: req.DeliveryWindow,
+		ExpiresAt:      expiresAt,
+		RetryPolicy:    req.RetryPolicy,
+		CallbackURL:    req.CallbackURL,
+	}
+
+	if effectiveSendAt.After(sendAt) {
+		notification.EffectiveSendAt = &effectiveSendAt
 	}
 
 	if err := h.storage.Create(ctx, notification); err != nil {
+		refundQuota(context.WithoutCancel(ctx))
+		slog.ErrorContext(ctx, "Failed to create notification", logging.KeyNotificationID, notification.ID, logging.KeyError, err)
 		http.Error(w, "Failed to create notification", http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.queue.PublishDelayed(ctx, notification); err != nil {
-		http.Error(w, "Failed to schedule notification", http.StatusInternalServerError)
-		return
-	}
+	metrics.Created.WithLabelValues(notification.Channel, string(notification.Priority)).Inc()
+	storage.RecordEvent(ctx, h.storage, notification.ID, models.Event{
+		Type:       models.EventCreated,
+		Actor:      actor(r),
+		OnBehalfOf: r.Header.Get("X-Actor"),
+		SendAt:     &effectiveSendAt,
+	})
+
+	h.relay.Wake()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -91,6 +195,35 @@ func (h *NotifyHandler) GetNotification(w http.ResponseWriter, r *http.Request)
 	json.NewEncoder(w).Encode(notification)
 }
 
+func (h *NotifyHandler) GetNotificationEvents(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		http.Error(w, "ID is required", http.StatusBadRequest)
+		return
+	}
+
+	notification, err := h.storage.GetByID(ctx, id)
+	if err != nil {
+		http.Error(w, "Failed to get notification", http.StatusInternalServerError)
+		return
+	}
+
+	if notification == nil {
+		http.Error(w, "Notification not found", http.StatusNotFound)
+		return
+	}
+
+	events, err := h.storage.GetEvents(ctx, id)
+	if err != nil {
+		http.Error(w, "Failed to get notification events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
 func (h *NotifyHandler) DeleteNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	id := chi.URLParam(r, "id")
@@ -110,12 +243,31 @@ func (h *NotifyHandler) DeleteNotification(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	if err := h.storage.Update(ctx, id, func(n *models.Notification) {
+	// Only notifications still waiting to be sent can be cancelled; one being
+	// sent or already settled keeps its status.
+	cancelled, err := h.storage.UpdateIf(ctx, id, func(n *models.Notification) bool {
+		if n.Status != models.StatusPending && n.Status != models.StatusRetrying {
+			return false
+		}
 		n.Status = models.StatusCancelled
-	}); err != nil {
+		n.NextRetry = nil
+		return true
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to cancel notification", logging.KeyNotificationID, id, logging.KeyError, err)
 		http.Error(w, "Failed to cancel notification", http.StatusInternalServerError)
 		return
 	}
+	if cancelled == nil {
+		http.Error(w, "Notification can no longer be cancelled", http.StatusConflict)
+		return
+	}
+
+	storage.RecordEvent(ctx, h.storage, id, models.Event{
+		Type:       models.EventCancelled,
+		Actor:      actor(r),
+		OnBehalfOf: r.Header.Get("X-Actor"),
+	})
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -132,15 +284,40 @@ func (h *NotifyHandler) GetAllNotifications(w http.ResponseWriter, r *http.Reque
 	json.NewEncoder(w).Encode(notifications)
 }
 
+// expiresAt resolves the deadline from an explicit expires_at, a max_delay
+// relative to the send time, or the configured default max delay.
+func (h *NotifyHandler) expiresAt(req *models.CreateNotificationRequest, sendAt time.Time) (*time.Time, error) {
+	if req.ExpiresAt != nil {
+		return req.ExpiresAt, nil
+	}
+
+	maxDelay := h.defaultMaxDelay
+	if req.MaxDelay != "" {
+		d, err := time.ParseDuration(req.MaxDelay)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid max_delay %q", req.MaxDelay)
+		}
+		maxDelay = d
+	}
+
+	if maxDelay <= 0 {
+		return nil, nil
+	}
+	expiresAt := sendAt.Add(maxDelay)
+	return &expiresAt, nil
+}
+
 func generateID() string {
-	return time.Now().Format("20060102150405") + "-" + randomString(6)
+	return uuid.NewString()
 }
 
-func randomString(n int) string {
-	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[time.Now().UnixNano()%int64(len(letters))]
+// actor names the caller in notification events by the API key that
+// authenticated the request, or just the API when no keys are configured.
+// The X-Actor header is client-supplied, so it is only recorded as the
+// event's OnBehalfOf.
+func actor(r *http.Request) string {
+	if id, ok := r.Context().Value(keyIDKey{}).(string); ok {
+		return "api:key-" + id
 	}
-	return string(b)
+	return "api"
 }
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/storage"
+	"notifier/internal/stream"
+	"notifier/internal/tenant"
+)
+
+const (
+	streamHeartbeat = 15 * time.Second
+	wsWriteTimeout  = 10 * time.Second
+)
+
+// StreamHandler pushes the caller's notification changes to live clients,
+// over Server-Sent Events or a WebSocket. Both accept comma separated
+// status and type filters, e.g. ?status=sent,failed&type=status.
+type StreamHandler struct {
+	hub      *stream.Hub
+	upgrader websocket.Upgrader
+}
+
+func NewStreamHandler(hub *stream.Hub) *StreamHandler {
+	return &StreamHandler{
+		hub: hub,
+	}
+}
+
+func (h *StreamHandler) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := streamFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid stream filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.hub.Subscribe(filter)
+	defer h.hub.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case change, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Failed to marshal change", logging.KeyNotificationID, change.Notification.ID, logging.KeyError, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", change.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (h *StreamHandler) StreamWebSocket(w http.ResponseWriter, r *http.Request) {
+	filter, err := streamFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid stream filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to upgrade change stream to WebSocket", logging.KeyError, err)
+		return
+	}
+	defer conn.Close()
+
+	sub := h.hub.Subscribe(filter)
+	defer h.hub.Unsubscribe(sub)
+
+	// Clients only ever close the socket; reading is needed to notice that
+	// and to answer pings.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				return
+			}
+		case change, ok := <-sub.C:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "stream interrupted"),
+					time.Now().Add(wsWriteTimeout))
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteJSON(change); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamFilter scopes the stream to the caller's tenant and applies the
+// status and type query parameters.
+func streamFilter(r *http.Request) (stream.Filter, error) {
+	filter := stream.Filter{TenantID: tenant.FromContext(r.Context())}
+
+	for _, value := range queryList(r, "status") {
+		status := models.NotificationStatus(value)
+		switch status {
+		case models.StatusPending, models.StatusSending, models.StatusRetrying, models.StatusSent,
+			models.StatusFailed, models.StatusCancelled, models.StatusExpired:
+		default:
+			return stream.Filter{}, fmt.Errorf("invalid status %q", value)
+		}
+		if filter.Statuses == nil {
+			filter.Statuses = make(map[models.NotificationStatus]bool)
+		}
+		filter.Statuses[status] = true
+	}
+
+	for _, value := range queryList(r, "type") {
+		switch value {
+		case storage.ChangeCreated, storage.ChangeUpdated, storage.ChangeStatus:
+		default:
+			return stream.Filter{}, fmt.Errorf("invalid type %q", value)
+		}
+		if filter.Types == nil {
+			filter.Types = make(map[string]bool)
+		}
+		filter.Types[value] = true
+	}
+
+	return filter, nil
+}
+
+func queryList(r *http.Request, name string) []string {
+	var values []string
+	for _, value := range r.URL.Query()[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,127 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// checkTimeout bounds a single dependency check, so a hung dependency fails
+// its probe instead of hanging it.
+const checkTimeout = 2 * time.Second
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports a problem with a dependency or component by returning an
+// error.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker serves /livez and /readyz. Liveness checks catch a process that is
+// wedged and needs a restart, such as a stopped consumer or a scheduler that
+// no longer ticks. Readiness checks catch dependencies that are unavailable
+// for now, such as Redis or the broker; /readyz runs the liveness checks as
+// well. Checks are added during startup, before the handlers are served.
+type Checker struct {
+	live  []namedCheck
+	ready []namedCheck
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+func (c *Checker) AddLive(name string, check Check) {
+	c.live = append(c.live, namedCheck{name: name, check: check})
+}
+
+func (c *Checker) AddReady(name string, check Check) {
+	c.ready = append(c.ready, namedCheck{name: name, check: check})
+}
+
+// Register adds the /livez and /readyz handlers to mux.
+func (c *Checker) Register(mux *http.ServeMux) {
+	mux.Handle("/livez", c.LiveHandler())
+	mux.Handle("/readyz", c.ReadyHandler())
+}
+
+func (c *Checker) LiveHandler() http.Handler {
+	return c.handler(func() []namedCheck { return c.live })
+}
+
+func (c *Checker) ReadyHandler() http.Handler {
+	return c.handler(func() []namedCheck {
+		checks := make([]namedCheck, 0, len(c.live)+len(c.ready))
+		checks = append(checks, c.live...)
+		return append(checks, c.ready...)
+	})
+}
+
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// handler runs the checks concurrently and answers 200 if all of them
+// passed, otherwise 503, with the result of every check as JSON.
+func (c *Checker) handler(checks func() []namedCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := run(r.Context(), checks())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != StatusOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func run(ctx context.Context, checks []namedCheck) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := c.check(checkCtx)
+			result := Result{Status: StatusOK, Duration: time.Since(start).String()}
+			if err != nil {
+				result.Status = StatusFail
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = result
+			if err != nil {
+				report.Status = StatusFail
+			}
+		}()
+	}
+	wg.Wait()
+
+	return report
+}
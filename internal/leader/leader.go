@@ -0,0 +1,246 @@
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	wbfredis "github.com/wb-go/wbf/redis"
+	"notifier/internal/logging"
+)
+
+const defaultTTL = 15 * time.Second
+
+// acquireScript takes the lock if it is free, issuing the next lease token,
+// or extends it if this owner already holds it. It returns the
+// owner's token, or -1 if someone else holds the lock.
+var acquireScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if current then
+	local owner, token = string.match(current, '^(.+):(%d+)$')
+	if owner == ARGV[1] then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		return tonumber(token)
+	end
+	return -1
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return token
+`)
+
+// releaseScript deletes the lock only while it still carries our token.
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// Coordinator elects owners for a fixed number of shards using one Redis
+// lock per shard. With a single shard it is plain leader election; with N
+// shards up to N replicas are active, each for the notifications that hash
+// to its shards. A replica that dies loses its shards once their locks
+// expire, and the others pick them up on their next renewal.
+//
+// Every acquisition increments a per-shard lease token. Owners call Confirm
+// before acting so that a replica that stalled past its lease notices and
+// stops. The token is not a fencing token: the work it guards, such as a
+// broker publish or a callback request, is not checked against it, so a
+// replica that stalls between Confirm and the work may still overlap with the
+// new owner. That work must stay safe to repeat.
+type Coordinator struct {
+	client *redis.Client
+	name   string
+	owner  string
+	shards int
+	ttl    time.Duration
+
+	mu     sync.RWMutex
+	tokens map[int]int64
+	seen   map[int]bool
+
+	stopChan chan struct{}
+	done     chan struct{}
+}
+
+func NewCoordinator(addr, name string, shards int) *Coordinator {
+	if shards < 1 {
+		shards = 1
+	}
+
+	hostname, _ := os.Hostname()
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return &Coordinator{
+		client: wbfredis.New(addr, "", 0).Client,
+		name:   name,
+		owner:  fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(suffix)),
+		shards: shards,
+		ttl:    defaultTTL,
+		tokens: make(map[int]int64),
+		seen:   make(map[int]bool),
+
+		stopChan: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start renews held shards and competes for free ones until stopped, then
+// releases everything it holds so another replica can take over at once.
+func (c *Coordinator) Start(ctx context.Context) {
+	go func() {
+		defer close(c.done)
+		defer c.release()
+
+		ticker := time.NewTicker(c.ttl / 3)
+		defer ticker.Stop()
+
+		c.refresh(ctx)
+		for {
+			select {
+			case <-ticker.C:
+				c.refresh(ctx)
+			case <-c.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Stop gives up the held shards and closes the Redis client.
+func (c *Coordinator) Stop() {
+	close(c.stopChan)
+	<-c.done
+	if err := c.client.Close(); err != nil {
+		slog.Error("Failed to close coordinator client", "coordinator", c.name, logging.KeyError, err)
+	}
+}
+
+func (c *Coordinator) lockKey(shard int) string {
+	return fmt.Sprintf("leader:%s:%d", c.name, shard)
+}
+
+func (c *Coordinator) tokenKey(shard int) string {
+	return fmt.Sprintf("leader:%s:%d:token", c.name, shard)
+}
+
+// refresh renews held shards first. A replica that holds nothing takes the
+// first free shard straight away; further shards are only taken once they
+// have stayed free for a whole round, which spreads shards over replicas that
+// start together while still failing over those of a dead replica.
+func (c *Coordinator) refresh(ctx context.Context) {
+	c.mu.RLock()
+	held := len(c.tokens)
+	c.mu.RUnlock()
+
+	for shard := 0; shard < c.shards; shard++ {
+		c.mu.RLock()
+		_, owned := c.tokens[shard]
+		seenFree := c.seen[shard]
+		c.mu.RUnlock()
+
+		if !owned && held > 0 && !seenFree {
+			free, err := c.client.Exists(ctx, c.lockKey(shard)).Result()
+			c.mu.Lock()
+			c.seen[shard] = err == nil && free == 0
+			c.mu.Unlock()
+			continue
+		}
+
+		token, err := acquireScript.Run(ctx, c.client,
+			[]string{c.lockKey(shard), c.tokenKey(shard)},
+			c.owner, c.ttl.Milliseconds(),
+		).Int64()
+
+		c.mu.Lock()
+		delete(c.seen, shard)
+		switch {
+		case err != nil:
+			slog.ErrorContext(ctx, "Failed to renew shard", "coordinator", c.name, "shard", shard, logging.KeyError, err)
+			delete(c.tokens, shard)
+		case token < 0:
+			if owned {
+				slog.WarnContext(ctx, "Lost shard", "coordinator", c.name, "shard", shard)
+			}
+			delete(c.tokens, shard)
+		default:
+			if !owned {
+				slog.InfoContext(ctx, "Acquired shard", "coordinator", c.name, "shard", shard, "shards", c.shards, "token", token)
+				held++
+			}
+			c.tokens[shard] = token
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Confirm checks that every held shard's lock still carries our lease token
+// and drops the ones that do not. It reports whether any shard is
+// still held. The locks are read without holding mu, so Owns is never held
+// up by Redis.
+func (c *Coordinator) Confirm(ctx context.Context) bool {
+	c.mu.RLock()
+	held := make(map[int]int64, len(c.tokens))
+	for shard, token := range c.tokens {
+		held[shard] = token
+	}
+	c.mu.RUnlock()
+
+	var stale []int
+	for shard, token := range held {
+		value, err := c.client.Get(ctx, c.lockKey(shard)).Result()
+		if err != nil || value != fmt.Sprintf("%s:%d", c.owner, token) {
+			slog.WarnContext(ctx, "Lease token is no longer current", "coordinator", c.name, "shard", shard, "token", token)
+			stale = append(stale, shard)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, shard := range stale {
+		// A renewal may have reacquired the shard meanwhile.
+		if c.tokens[shard] == held[shard] {
+			delete(c.tokens, shard)
+		}
+	}
+	return len(c.tokens) > 0
+}
+
+// Owns reports whether the shard that id hashes to is held by this replica.
+func (c *Coordinator) Owns(id string) bool {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	shard := int(h.Sum32() % uint32(c.shards))
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, owned := c.tokens[shard]
+	return owned
+}
+
+func (c *Coordinator) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for shard, token := range c.tokens {
+		value := fmt.Sprintf("%s:%d", c.owner, token)
+		if err := releaseScript.Run(ctx, c.client, []string{c.lockKey(shard)}, value).Err(); err != nil {
+			slog.ErrorContext(ctx, "Failed to release shard", "coordinator", c.name, "shard", shard, logging.KeyError, err)
+		}
+		delete(c.tokens, shard)
+	}
+}
@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Field names shared by every component, so one query finds a notification
+// across API and worker logs.
+const (
+	KeyRequestID      = "request_id"
+	KeyNotificationID = "notification_id"
+	KeyTenant         = "tenant"
+	KeyAttempt        = "attempt"
+	KeyError          = "error"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// level is shared by the handlers installed by Setup, so SetLevel applies
+// to loggers created before it was called.
+var level slog.LevelVar
+
+// Setup installs the default slog logger writing in format, text or json
+// (default text). Output of the standard log package goes through the same
+// handler.
+func Setup(minLevel slog.Level, format string) error {
+	level.Set(minLevel)
+
+	options := &slog.HandlerOptions{Level: &level}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// SetLevel changes the minimum level of the logger installed by Setup.
+func SetLevel(minLevel slog.Level) {
+	level.Set(minLevel)
+}
+
+type attrsKey struct{}
+
+type requestIDKey struct{}
+
+// With returns ctx carrying attrs, which are added to every record logged
+// with it.
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(combined, existing...)
+	combined = append(combined, attrs...)
+	return context.WithValue(ctx, attrsKey{}, combined)
+}
+
+// WithRequestID returns ctx logging, and passing on to the queue, the ID of
+// the API request that caused the work.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return With(ctx, slog.String(KeyRequestID, id))
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// contextHandler adds the attributes stored with With and the trace and
+// span IDs of the current span.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(attrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Middleware replaces chi's request logger. It must run after
+// middleware.RequestID, whose ID it puts into the request context for the
+// handlers' logs, and logs every request once it has been served.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithRequestID(r.Context(), middleware.GetReqID(r.Context()))
+
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(ctx, level, "Request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,220 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"notifier/internal/breaker"
+	"notifier/internal/logging"
+	"notifier/internal/queue"
+	"notifier/internal/storage"
+	"notifier/internal/tenant"
+)
+
+const namespace = "notifier"
+
+// Reasons a notification ends up failed.
+const (
+	ReasonPermanent       = "permanent"
+	ReasonMaxRetries      = "max_retries"
+	ReasonPolicyExhausted = "policy_exhausted"
+	ReasonLeaseExpired    = "lease_expired"
+)
+
+// collectTimeout bounds the storage and broker calls made during a scrape.
+const collectTimeout = 5 * time.Second
+
+var (
+	Created = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_created_total",
+		Help:      "Notifications accepted by the API.",
+	}, []string{"channel", "priority"})
+
+	Published = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_published_total",
+		Help:      "Notifications handed to the queue, by the component that published them.",
+	}, []string{"source"})
+
+	Sent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_sent_total",
+		Help:      "Notifications delivered.",
+	}, []string{"channel"})
+
+	Failed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "notifications_failed_total",
+		Help:      "Notifications given up on, by the reason they failed.",
+	}, []string{"channel", "reason"})
+
+	Attempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "send_attempts_total",
+		Help:      "Delivery attempts, by whether they succeeded.",
+	}, []string{"channel", "result"})
+
+	ScheduleLag = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "schedule_lag_seconds",
+		Help:      "Time between when a notification was due, after delays such as its delivery window, and its delivery.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"channel"})
+
+	SendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "send_duration_seconds",
+		Help:      "Time spent in a single delivery attempt.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"channel"})
+
+	HandlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time spent handling a queue message, by whether the message was settled.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+// Handler serves the default registry in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterQueueDepth exports the queue's message counts, read from the broker
+// on every scrape.
+func RegisterQueueDepth(depths queue.Depths) {
+	prometheus.MustRegister(&queueDepthCollector{depths: depths})
+}
+
+// RegisterStatusCounts exports the number of notifications in each status
+// per tenant from the counters kept by the storage.
+func RegisterStatusCounts(store storage.Storage) {
+	prometheus.MustRegister(&statusCollector{storage: store})
+}
+
+// BreakerStates lists the circuit breakers, as breaker.Registry does.
+type BreakerStates interface {
+	States(ctx context.Context) ([]breaker.State, error)
+}
+
+// RegisterBreakerStates exports the state of every circuit breaker, read on
+// every scrape. Breakers are shared by all replicas, so only one process per
+// deployment should register them.
+func RegisterBreakerStates(breakers BreakerStates) {
+	prometheus.MustRegister(&breakerCollector{breakers: breakers})
+}
+
+var queueDepthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "queue", "depth"),
+	"Messages waiting in each queue.",
+	[]string{"queue"}, nil,
+)
+
+type queueDepthCollector struct {
+	depths queue.Depths
+}
+
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	depths, err := c.depths.Depths(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get queue depths", logging.KeyError, err)
+		ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+		return
+	}
+	for name, depth := range depths {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(depth), name)
+	}
+}
+
+var statusDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "notifications"),
+	"Notifications currently in each status.",
+	[]string{"tenant", "status"}, nil,
+)
+
+type statusCollector struct {
+	storage storage.Storage
+}
+
+func (c *statusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- statusDesc
+}
+
+func (c *statusCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	tenants, err := c.storage.Tenants(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get tenants", logging.KeyError, err)
+		ch <- prometheus.NewInvalidMetric(statusDesc, err)
+		return
+	}
+
+	for _, tenantID := range tenants {
+		counts, err := c.storage.StatusCounts(tenant.WithTenant(ctx, tenantID))
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to get status counts", logging.KeyTenant, tenantID, logging.KeyError, err)
+			continue
+		}
+		for status, count := range counts {
+			ch <- prometheus.MustNewConstMetric(statusDesc, prometheus.GaugeValue, float64(count), tenantID, string(status))
+		}
+	}
+}
+
+var breakerStateDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "breaker_state"),
+	"Circuit breakers by destination, 1 for the state each one is in and 0 for the others.",
+	[]string{"channel", "host", "state"}, nil,
+)
+
+var breakerStates = []string{breaker.StateClosed, breaker.StateOpen, breaker.StateHalfOpen}
+
+type breakerCollector struct {
+	breakers BreakerStates
+}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	states, err := c.breakers.States(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to get circuit breakers", logging.KeyError, err)
+		ch <- prometheus.NewInvalidMetric(breakerStateDesc, err)
+		return
+	}
+
+	for _, state := range states {
+		// Keys are the channel and, when the recipient has one, its host.
+		channel, host, _ := strings.Cut(state.Key, ":")
+		for _, name := range breakerStates {
+			value := 0.0
+			if state.State == name {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, value, channel, host, name)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"notifier/internal/breaker"
+)
+
+type fakeBreakers struct {
+	states []breaker.State
+	err    error
+}
+
+func (f fakeBreakers) States(context.Context) ([]breaker.State, error) {
+	return f.states, f.err
+}
+
+func scrape(t *testing.T, collector prometheus.Collector) (int, string) {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	server := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read scrape: %v", err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestBreakerStateGauge(t *testing.T) {
+	collector := &breakerCollector{breakers: fakeBreakers{states: []breaker.State{
+		{Key: "webhook:api.example.com", State: breaker.StateOpen},
+		{Key: "email:example.org", State: breaker.StateHalfOpen},
+		{Key: "telegram", State: breaker.StateClosed},
+	}}}
+
+	status, body := scrape(t, collector)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, body:\n%s", status, body)
+	}
+
+	for _, line := range []string{
+		`notifier_breaker_state{channel="webhook",host="api.example.com",state="open"} 1`,
+		`notifier_breaker_state{channel="webhook",host="api.example.com",state="closed"} 0`,
+		`notifier_breaker_state{channel="webhook",host="api.example.com",state="half_open"} 0`,
+		`notifier_breaker_state{channel="email",host="example.org",state="half_open"} 1`,
+		`notifier_breaker_state{channel="email",host="example.org",state="open"} 0`,
+		`notifier_breaker_state{channel="telegram",host="",state="closed"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("scrape is missing %s\n%s", line, body)
+		}
+	}
+}
+
+func TestBreakerStateGaugeFailsScrapeOnError(t *testing.T) {
+	collector := &breakerCollector{breakers: fakeBreakers{err: errors.New("redis down")}}
+
+	if status, body := scrape(t, collector); status != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d, body:\n%s", status, http.StatusInternalServerError, body)
+	}
+}
@@ -12,10 +12,50 @@ const (
 	StatusFailed    NotificationStatus = "failed"
 	StatusCancelled NotificationStatus = "cancelled"
 	StatusRetrying  NotificationStatus = "retrying"
+	StatusExpired   NotificationStatus = "expired"
+	// StatusSending marks a notification claimed by a worker for one
+	// delivery attempt until LeaseUntil.
+	StatusSending NotificationStatus = "sending"
 )
 
+// Final reports whether the status ends the notification's delivery, which
+// is when callbacks are sent.
+func (s NotificationStatus) Final() bool {
+	switch s {
+	case StatusSent, StatusFailed, StatusCancelled, StatusExpired:
+		return true
+	}
+	return false
+}
+
+type Priority string
+
+const (
+	PriorityLow      Priority = "low"
+	PriorityNormal   Priority = "normal"
+	PriorityHigh     Priority = "high"
+	PriorityCritical Priority = "critical"
+)
+
+// Priorities lists every priority from most to least urgent.
+var Priorities = []Priority{PriorityCritical, PriorityHigh, PriorityNormal, PriorityLow}
+
+func (p Priority) Valid() bool {
+	switch p {
+	case PriorityLow, PriorityNormal, PriorityHigh, PriorityCritical:
+		return true
+	}
+	return false
+}
+
+const DefaultChannel = "log"
+
 type Notification struct {
 	ID         string             `json:"id"`
+	TenantID   string             `json:"tenant_id"`
+	Channel    string             `json:"channel"`
+	Recipient  string             `json:"recipient,omitempty"`
+	Priority   Priority           `json:"priority"`
 	Message    string             `json:"message"`
 	SendAt     time.Time          `json:"send_at"`
 	Status     NotificationStatus `json:"status"`
@@ -24,10 +64,117 @@ type Notification struct {
 	Attempts   int                `json:"attempts"`
 	MaxRetries int                `json:"max_retries"`
 	NextRetry  *time.Time         `json:"next_retry,omitempty"`
+
+	DeliveryWindow  *DeliveryWindow `json:"delivery_window,omitempty"`
+	EffectiveSendAt *time.Time      `json:"effective_send_at,omitempty"`
+	ExpiresAt       *time.Time      `json:"expires_at,omitempty"`
+
+	AttemptID  string     `json:"attempt_id,omitempty"`
+	LeaseUntil *time.Time `json:"lease_until,omitempty"`
+
+	RetryPolicy string `json:"retry_policy,omitempty"`
+	// LastBackoffMs is the delay before the latest retry, which decorrelated
+	// jitter grows from.
+	LastBackoffMs int64  `json:"last_backoff_ms,omitempty"`
+	LastError     string `json:"last_error,omitempty"`
+
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+func (n *Notification) Expired(now time.Time) bool {
+	return n.ExpiresAt != nil && !now.Before(*n.ExpiresAt)
+}
+
+// DueAt is the time the notification should actually go out: SendAt unless
+// it was pushed back by a delivery window, rate limit or retry.
+func (n *Notification) DueAt() time.Time {
+	if n.EffectiveSendAt != nil {
+		return *n.EffectiveSendAt
+	}
+	return n.SendAt
+}
+
+// DeliveryWindow restricts delivery to a daily time range, e.g. 08:00-21:00
+// on weekdays in the recipient's timezone. End before Start means the window
+// runs past midnight.
+type DeliveryWindow struct {
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Timezone string   `json:"timezone,omitempty"`
+	Days     []string `json:"days,omitempty"`
 }
 
 type CreateNotificationRequest struct {
+	Channel    string    `json:"channel,omitempty"`
+	Recipient  string    `json:"recipient,omitempty"`
+	Priority   Priority  `json:"priority,omitempty"`
 	Message    string    `json:"message"`
 	SendAt     time.Time `json:"send_at"`
 	MaxRetries int       `json:"max_retries,omitempty"`
+
+	DeliveryWindow *DeliveryWindow `json:"delivery_window,omitempty"`
+	ExpiresAt      *time.Time      `json:"expires_at,omitempty"`
+	MaxDelay       string          `json:"max_delay,omitempty"`
+	RetryPolicy    string          `json:"retry_policy,omitempty"`
+	CallbackURL    string          `json:"callback_url,omitempty"`
+}
+
+// OutboxEntry records a notification that still has to be published to the
+// queue. It is written together with the notification and removed once the
+// broker has confirmed the publish.
+type OutboxEntry struct {
+	ID             string    `json:"id"`
+	TenantID       string    `json:"tenant_id"`
+	NotificationID string    `json:"notification_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	// Trace holds the trace context of the request that created the
+	// notification, so the relay's publish joins the same trace.
+	Trace map[string]string `json:"trace,omitempty"`
+	// RequestID is the ID of that request, for correlating worker logs.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// CallbackEntry is a final status change that still has to be reported. It
+// is written together with the status change and removed once every target
+// has accepted it. Targets are resolved on the first delivery and shrink as
+// targets accept it, so retries only go to the ones that failed.
+type CallbackEntry struct {
+	ID             string             `json:"id"`
+	TenantID       string             `json:"tenant_id"`
+	NotificationID string             `json:"notification_id"`
+	Status         NotificationStatus `json:"status"`
+	OccurredAt     time.Time          `json:"occurred_at"`
+	Attempts       int                `json:"attempts"`
+	Targets        []string           `json:"targets,omitempty"`
+}
+
+type EventType string
+
+const (
+	EventCreated        EventType = "created"
+	EventPublished      EventType = "published"
+	EventScheduled      EventType = "scheduled"
+	EventAttemptStarted EventType = "attempt_started"
+	EventAttemptFailed  EventType = "attempt_failed"
+	EventSent           EventType = "sent"
+	EventFailed         EventType = "failed"
+	EventCancelled      EventType = "cancelled"
+	EventExpired        EventType = "expired"
+)
+
+// Event is one entry in a notification's append-only history. Actor is the
+// API key that made the call or the component that acted, e.g. worker or
+// scheduler. OnBehalfOf is the user an API caller says it acts for; nothing
+// verifies it.
+type Event struct {
+	Type       EventType  `json:"type"`
+	At         time.Time  `json:"at"`
+	Actor      string     `json:"actor"`
+	OnBehalfOf string     `json:"on_behalf_of,omitempty"`
+	Attempt    int        `json:"attempt,omitempty"`
+	AttemptID  string     `json:"attempt_id,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Code       int        `json:"code,omitempty"`
+	SendAt     *time.Time `json:"send_at,omitempty"`
+	Detail     string     `json:"detail,omitempty"`
 }
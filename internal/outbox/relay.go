@@ -0,0 +1,128 @@
+package outbox
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+
+	"notifier/internal/logging"
+	"notifier/internal/metrics"
+	"notifier/internal/models"
+	"notifier/internal/queue"
+	"notifier/internal/storage"
+	"notifier/internal/tenant"
+	"notifier/internal/tracing"
+)
+
+const (
+	batchSize    = 100
+	claimLease   = 30 * time.Second
+	pollInterval = time.Second
+)
+
+// Relay publishes outbox entries written by storage.Create and removes them
+// once the broker has confirmed the publish, giving at-least-once handoff
+// from the API to the worker.
+type Relay struct {
+	storage  storage.Storage
+	queue    queue.Queue
+	wake     chan struct{}
+	stopChan chan struct{}
+}
+
+func NewRelay(storage storage.Storage, queue queue.Queue) *Relay {
+	return &Relay{
+		storage:  storage,
+		queue:    queue,
+		wake:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (r *Relay) Start(ctx context.Context) {
+	go r.run(ctx)
+	slog.Info("Outbox relay started")
+}
+
+func (r *Relay) Stop() {
+	close(r.stopChan)
+	slog.Info("Outbox relay stopped")
+}
+
+// Wake asks the relay to publish right away instead of waiting for the next
+// poll, e.g. after a notification was created.
+func (r *Relay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Relay) run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.relay(ctx)
+		case <-r.wake:
+			r.relay(ctx)
+		case <-r.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Relay) relay(ctx context.Context) {
+	for {
+		entries, err := r.storage.ClaimOutbox(ctx, batchSize, claimLease)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming outbox entries", logging.KeyError, err)
+			return
+		}
+
+		for _, entry := range entries {
+			// The publish continues the trace of the request that created
+			// the notification and logs with its request ID.
+			traceCtx := tracing.Extract(ctx, propagation.MapCarrier(entry.Trace))
+			tenantCtx := tenant.WithTenant(logging.WithRequestID(traceCtx, entry.RequestID), entry.TenantID)
+			tenantCtx = logging.With(tenantCtx,
+				slog.String(logging.KeyNotificationID, entry.NotificationID),
+				slog.String(logging.KeyTenant, entry.TenantID),
+			)
+
+			notification, err := r.storage.GetByID(tenantCtx, entry.NotificationID)
+			if err != nil {
+				slog.ErrorContext(tenantCtx, "Error getting notification", logging.KeyError, err)
+				continue
+			}
+
+			if notification != nil {
+				if err := r.queue.PublishDelayed(tenantCtx, notification); err != nil {
+					slog.ErrorContext(tenantCtx, "Failed to publish notification", logging.KeyError, err)
+					continue
+				}
+				metrics.Published.WithLabelValues("relay").Inc()
+				dueAt := notification.DueAt()
+				storage.RecordEvent(tenantCtx, r.storage, notification.ID, models.Event{
+					Type:   models.EventPublished,
+					Actor:  "relay",
+					SendAt: &dueAt,
+				})
+			}
+
+			if err := r.storage.CompleteOutbox(ctx, entry.ID); err != nil {
+				slog.ErrorContext(tenantCtx, "Failed to complete outbox entry", logging.KeyError, err)
+			}
+		}
+
+		if len(entries) < batchSize {
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/wb-go/wbf/rabbitmq"
+)
+
+// Delays are handled by a ladder of delay levels, one per bit of the delay in
+// seconds: level n holds a message for 2^n seconds. The routing key spells
+// out the delay bits from the highest level down, followed by the final
+// routing key, e.g. "0.….1.0.1.ready". At each level a 1 bit routes the
+// message into that level's TTL queue, a 0 bit skips straight to the next
+// level, and expired messages are dead-lettered into the next level with
+// their routing key intact. After level 0 the message reaches the deliver
+// exchange, which binds the ready queues by their routing key suffix.
+//
+// RabbitMQ caps queue TTLs at 2^32-1 ms, so 23 levels (about 97 days) is the
+// most the ladder can hold; longer delays are republished when they arrive
+// too early.
+const (
+	delayLevels          = 23
+	delayDeliverExchange = "notifications.delay.deliver"
+	maxDelay             = (1<<delayLevels - 1) * time.Second
+)
+
+func delayLevelName(level int) string {
+	return fmt.Sprintf("notifications.delay.l%02d", level)
+}
+
+func delayTopExchange() string {
+	return delayLevelName(delayLevels - 1)
+}
+
+// delayRoutingKey rounds the delay up to whole seconds and encodes it in
+// front of the destination routing key.
+func delayRoutingKey(delay time.Duration, destination string) string {
+	delay = min(delay, maxDelay)
+	seconds := uint64(math.Ceil(delay.Seconds()))
+
+	var b strings.Builder
+	for level := delayLevels - 1; level >= 0; level-- {
+		if seconds&(1<<level) != 0 {
+			b.WriteString("1.")
+		} else {
+			b.WriteString("0.")
+		}
+	}
+	b.WriteString(destination)
+	return b.String()
+}
+
+// levelPattern matches routing keys whose bit for the given level equals bit.
+func levelPattern(level int, bit string) string {
+	return strings.Repeat("*.", delayLevels-1-level) + bit + ".#"
+}
+
+func setupDelayLevels(client *rabbitmq.RabbitClient) error {
+	err := client.DeclareExchange(delayDeliverExchange, "topic", true, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare delay deliver exchange: %w", err)
+	}
+
+	ch, err := client.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	for level := 0; level < delayLevels; level++ {
+		name := delayLevelName(level)
+		next := delayDeliverExchange
+		if level > 0 {
+			next = delayLevelName(level - 1)
+		}
+
+		if err := client.DeclareExchange(name, "topic", true, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare delay exchange %s: %w", name, err)
+		}
+
+		queueArgs := map[string]interface{}{
+			"x-dead-letter-exchange": next,
+			"x-message-ttl":          int64(time.Duration(1<<level) * time.Second / time.Millisecond),
+		}
+		if err := client.DeclareQueue(name, name, levelPattern(level, "1"), true, false, true, queueArgs); err != nil {
+			return fmt.Errorf("failed to declare delay queue %s: %w", name, err)
+		}
+
+		if err := ch.ExchangeBind(next, levelPattern(level, "0"), name, false, nil); err != nil {
+			return fmt.Errorf("failed to bind delay exchange %s to %s: %w", name, next, err)
+		}
+	}
+
+	return nil
+}
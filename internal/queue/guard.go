@@ -0,0 +1,198 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/tenant"
+)
+
+const (
+	headerDeliveryCount  = "x-delivery-count"
+	headerDeadLetterID   = "x-dead-letter-id"
+	headerDeathReason    = "x-death-reason"
+	headerDestination    = "x-original-routing-key"
+	headerDeadLetteredAt = "x-dead-lettered-at"
+	headerTenant         = "x-tenant-id"
+	headerRequestID      = "x-request-id"
+
+	// headerNotBefore carries the due time (unix ms) of delayed messages on
+	// brokers that cannot hold a message back themselves.
+	headerNotBefore = "x-not-before"
+
+	// headerRetryTarget and headerLevelDue route a message through the retry
+	// levels: the ready destination it returns to and the time (unix ms) its
+	// current level's delay is over.
+	headerRetryTarget = "x-retry-destination"
+	headerLevelDue    = "x-level-due"
+
+	maxDeliveries   = 5
+	maxRedeliverGap = 5 * time.Minute
+)
+
+// ErrPoisonMessage marks deliveries that can never be processed, such as
+// bodies that fail to unmarshal. They are parked without further attempts.
+var ErrPoisonMessage = errors.New("poison message")
+
+// ErrInterrupted is returned by handlers that gave up on a delivery because
+// the consumer is shutting down. It is not counted as a failed delivery; the
+// backend nacks it so it is redelivered as is.
+var ErrInterrupted = errors.New("delivery interrupted by shutdown")
+
+// NotReadyError is returned by handlers for messages that arrived before
+// their due time. They are delayed again instead of being requeued.
+type NotReadyError struct {
+	Until time.Time
+}
+
+func (e *NotReadyError) Error() string {
+	return fmt.Sprintf("notification not ready until %v", e.Until)
+}
+
+type DeadLetter struct {
+	ID             string    `json:"id"`
+	TenantID       string    `json:"tenant_id,omitempty"`
+	Reason         string    `json:"reason"`
+	RoutingKey     string    `json:"routing_key"`
+	Deliveries     int       `json:"deliveries"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
+	Body           string    `json:"body"`
+}
+
+// settler is the part of a backend guard needs to move a message on.
+type settler interface {
+	redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error
+	park(ctx context.Context, msg *Message) error
+}
+
+// guard wraps a handler so that failed deliveries never loop hot: not-ready
+// messages are delayed until due, failures are redelivered with backoff and a
+// delivery counter, and messages that exceed the cap or are poison are parked
+// as dead letters. The original delivery is acknowledged once it has been
+// redelivered or parked; only a failure to do so, or an interrupted delivery,
+// is returned.
+func guard(handler Handler, s settler, destination string) Handler {
+	return func(ctx context.Context, msg *Message) error {
+		handleErr := handler(ctx, msg)
+		if handleErr == nil || errors.Is(handleErr, ErrInterrupted) {
+			return handleErr
+		}
+
+		var notReady *NotReadyError
+		if errors.As(handleErr, &notReady) {
+			return s.redeliver(ctx, msg, destination, calculateDelay(notReady.Until))
+		}
+
+		deliveries := deliveryCount(msg.Headers) + 1
+		msg.Headers = copyHeaders(msg.Headers)
+		msg.Headers[headerDeliveryCount] = int32(deliveries)
+
+		if errors.Is(handleErr, ErrPoisonMessage) || deliveries >= maxDeliveries {
+			markDead(msg, destination, handleErr)
+			if err := s.park(ctx, msg); err != nil {
+				return fmt.Errorf("failed to dead-letter message: %w", err)
+			}
+			slog.WarnContext(ctx, "Message dead-lettered",
+				"dead_letter_id", msg.Headers[headerDeadLetterID], "deliveries", deliveries, logging.KeyError, handleErr)
+			return nil
+		}
+
+		delay := min(time.Duration(math.Pow(2, float64(deliveries)))*time.Second, maxRedeliverGap)
+		slog.WarnContext(ctx, "Delivery failed, redelivering",
+			"deliveries", deliveries, "max_deliveries", maxDeliveries, "delay", delay, logging.KeyError, handleErr)
+		return s.redeliver(ctx, msg, destination, delay)
+	}
+}
+
+func markDead(msg *Message, destination string, reason error) {
+	msg.Headers[headerDeadLetterID] = fmt.Sprintf("%d", time.Now().UnixNano())
+	msg.Headers[headerDeathReason] = reason.Error()
+	msg.Headers[headerDestination] = destination
+	msg.Headers[headerDeadLetteredAt] = time.Now().UTC().Format(time.RFC3339)
+
+	var notification models.Notification
+	if json.Unmarshal(msg.Body, &notification) == nil {
+		msg.Headers[headerTenant] = notification.TenantID
+	}
+}
+
+func toDeadLetter(msg *Message) DeadLetter {
+	letter := DeadLetter{
+		TenantID:   letterTenant(msg.Headers),
+		Deliveries: deliveryCount(msg.Headers),
+		Body:       string(msg.Body),
+	}
+	letter.ID, _ = msg.Headers[headerDeadLetterID].(string)
+	letter.Reason, _ = msg.Headers[headerDeathReason].(string)
+	letter.RoutingKey, _ = msg.Headers[headerDestination].(string)
+	if at, ok := msg.Headers[headerDeadLetteredAt].(string); ok {
+		letter.DeadLetteredAt, _ = time.Parse(time.RFC3339, at)
+	}
+	return letter
+}
+
+// revive strips the dead letter headers and resets the delivery counter
+// before a parked message is replayed.
+func revive(msg *Message) (string, *Message) {
+	destination, _ := msg.Headers[headerDestination].(string)
+	headers := copyHeaders(msg.Headers)
+	for _, key := range []string{headerDeliveryCount, headerDeadLetterID, headerDeathReason,
+		headerDestination, headerDeadLetteredAt, headerTenant} {
+		delete(headers, key)
+	}
+	return destination, &Message{Body: msg.Body, Headers: headers}
+}
+
+func letterTenant(headers map[string]interface{}) string {
+	if tenantID, ok := headers[headerTenant].(string); ok && tenantID != "" {
+		return tenantID
+	}
+	return tenant.Default
+}
+
+func deliveryCount(headers map[string]interface{}) int {
+	switch count := headers[headerDeliveryCount].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	case float64:
+		return int(count)
+	case string:
+		n, _ := strconv.Atoi(count)
+		return n
+	}
+	return 0
+}
+
+// headerTime reads a unix millisecond header written by brokers whose header
+// values are strings.
+func headerTime(headers map[string]interface{}, key string) (time.Time, bool) {
+	value, ok := headers[key].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(headers)+1)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
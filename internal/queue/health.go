@@ -0,0 +1,34 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// consumerTracker counts the consuming goroutines a queue started and how
+// many of them are still running, for ConsumersRunning.
+type consumerTracker struct {
+	started atomic.Int32
+	running atomic.Int32
+}
+
+func (t *consumerTracker) goConsume(consume func()) {
+	t.started.Add(1)
+	t.running.Add(1)
+	go func() {
+		defer t.running.Add(-1)
+		consume()
+	}()
+}
+
+func (t *consumerTracker) check() error {
+	started := t.started.Load()
+	if started == 0 {
+		return errors.New("no consumers started")
+	}
+	if running := t.running.Load(); running < started {
+		return fmt.Errorf("%d of %d consumers stopped", started-running, started)
+	}
+	return nil
+}
@@ -0,0 +1,430 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/tracing"
+)
+
+const (
+	kafkaReadyPrefix = "notifications.ready."
+	kafkaRetryPrefix = "notifications.retry."
+	kafkaDeadTopic   = "notifications.dead"
+	kafkaGroupPrefix = "notifier-"
+	kafkaPartitions  = 6
+	kafkaReplication = 1
+	kafkaSettlePause = time.Second
+)
+
+// KafkaQueue keeps one ready topic per priority. Messages are keyed by
+// tenant and recipient, so each recipient's notifications land on one
+// partition and are handled in order; offsets are committed only after the
+// handler has settled a message. Dead letters are written to
+// notifications.dead and are left to Kafka tooling.
+type KafkaQueue struct {
+	brokers []string
+	writer  *kafka.Writer
+
+	concurrency Concurrency
+
+	mu      sync.Mutex
+	readers []*kafka.Reader
+	running consumerTracker
+}
+
+func NewKafkaQueue(brokers []string, concurrency Concurrency) (*KafkaQueue, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("no Kafka brokers configured")
+	}
+
+	if err := createKafkaTopics(brokers); err != nil {
+		return nil, fmt.Errorf("failed to create topics: %w", err)
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+	}
+
+	slog.Info("Kafka queue initialized successfully")
+	return &KafkaQueue{brokers: brokers, writer: writer, concurrency: concurrency}, nil
+}
+
+func createKafkaTopics(brokers []string) error {
+	conn, err := kafka.Dial("tcp", brokers[0])
+	if err != nil {
+		return fmt.Errorf("failed to connect to Kafka: %w", err)
+	}
+	defer conn.Close()
+
+	controller, err := conn.Controller()
+	if err != nil {
+		return fmt.Errorf("failed to find controller: %w", err)
+	}
+
+	controllerConn, err := kafka.Dial("tcp", net.JoinHostPort(controller.Host, strconv.Itoa(controller.Port)))
+	if err != nil {
+		return fmt.Errorf("failed to connect to controller: %w", err)
+	}
+	defer controllerConn.Close()
+
+	topics := []kafka.TopicConfig{{Topic: kafkaDeadTopic, NumPartitions: 1, ReplicationFactor: kafkaReplication}}
+	for _, priority := range models.Priorities {
+		topics = append(topics, kafka.TopicConfig{
+			Topic:             kafkaReadyPrefix + string(priority),
+			NumPartitions:     kafkaPartitions,
+			ReplicationFactor: kafkaReplication,
+		})
+	}
+	for level := range retryLevels {
+		topics = append(topics, kafka.TopicConfig{
+			Topic:             kafkaRetryTopic(level),
+			NumPartitions:     kafkaPartitions,
+			ReplicationFactor: kafkaReplication,
+		})
+	}
+
+	return controllerConn.CreateTopics(topics...)
+}
+
+func kafkaRetryTopic(level int) string {
+	return fmt.Sprintf("%s%ds", kafkaRetryPrefix, int(retryLevels[level].Seconds()))
+}
+
+func (q *KafkaQueue) PublishDelayed(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendKafka, "PublishDelayed", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	delay := calculateDelay(notification.DueAt())
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.redeliver(ctx, msg, string(priorityOf(notification)), delay); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Published notification", logging.KeyNotificationID, notification.ID, "delay", delay)
+	return nil
+}
+
+func (q *KafkaQueue) PublishImmediate(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendKafka, "PublishImmediate", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.redeliver(ctx, msg, string(priorityOf(notification)), 0); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Published immediate notification", logging.KeyNotificationID, notification.ID)
+	return nil
+}
+
+func (q *KafkaQueue) Consume(ctx context.Context, handler Handler) error {
+	for _, priority := range models.Priorities {
+		topic := kafkaReadyPrefix + string(priority)
+		guarded := guard(handler, q, string(priority))
+		for i := 0; i < q.concurrency.consumers(priority); i++ {
+			reader := q.newReader(topic)
+			q.running.goConsume(func() { q.consume(ctx, reader, guarded) })
+		}
+	}
+
+	for level := range retryLevels {
+		reader := q.newReader(kafkaRetryTopic(level))
+		q.running.goConsume(func() { q.consume(ctx, reader, q.forward) })
+	}
+
+	slog.Info("Consumers started successfully")
+	return nil
+}
+
+func (q *KafkaQueue) newReader(topic string) *kafka.Reader {
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     q.brokers,
+		GroupID:     kafkaGroupPrefix + topic,
+		Topic:       topic,
+		MinBytes:    1,
+		MaxBytes:    10e6,
+		MaxWait:     time.Second,
+		StartOffset: kafka.FirstOffset,
+	})
+
+	q.mu.Lock()
+	q.readers = append(q.readers, reader)
+	q.mu.Unlock()
+	return reader
+}
+
+// consume handles one message at a time so a partition is processed in
+// order. A message whose handler fails to settle it is retried in place and
+// its offset is not committed, so a crash redelivers it.
+func (q *KafkaQueue) consume(ctx context.Context, reader *kafka.Reader, handler Handler) {
+	for ctx.Err() == nil {
+		m, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to fetch message", "topic", reader.Config().Topic, logging.KeyError, err)
+				time.Sleep(kafkaSettlePause)
+			}
+			continue
+		}
+
+		for {
+			err := handler(ctx, fromKafkaMessage(m))
+			if err == nil {
+				break
+			}
+			slog.ErrorContext(ctx, "Failed to settle message, retrying",
+				"topic", m.Topic, "partition", m.Partition, "offset", m.Offset, logging.KeyError, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(kafkaSettlePause):
+			}
+		}
+
+		if err := reader.CommitMessages(ctx, m); err != nil && ctx.Err() == nil {
+			slog.ErrorContext(ctx, "Failed to commit offset",
+				"topic", m.Topic, "partition", m.Partition, "offset", m.Offset, logging.KeyError, err)
+		}
+	}
+}
+
+// forward moves a retry-level message on once its level delay has passed:
+// to the next level if the message is still not due, else to its ready topic.
+func (q *KafkaQueue) forward(ctx context.Context, msg *Message) error {
+	if due, ok := headerTime(msg.Headers, headerLevelDue); ok {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(due)):
+		}
+	}
+
+	destination, _ := msg.Headers[headerRetryTarget].(string)
+	if destination == "" {
+		destination = string(models.PriorityNormal)
+	}
+
+	var remaining time.Duration
+	if until, ok := headerTime(msg.Headers, headerNotBefore); ok {
+		remaining = time.Until(until)
+	}
+	return q.redeliver(ctx, msg, destination, remaining)
+}
+
+func (q *KafkaQueue) redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error {
+	headers := copyHeaders(msg.Headers)
+	delete(headers, headerLevelDue)
+
+	topic := kafkaReadyPrefix + destination
+	if delay > 0 {
+		level := retryLevel(delay)
+		topic = kafkaRetryTopic(level)
+		headers[headerNotBefore] = time.Now().Add(delay).UnixMilli()
+		headers[headerLevelDue] = time.Now().Add(retryLevels[level]).UnixMilli()
+		headers[headerRetryTarget] = destination
+	} else {
+		delete(headers, headerNotBefore)
+		delete(headers, headerRetryTarget)
+	}
+
+	if err := q.write(ctx, topic, msg.Body, headers); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+func (q *KafkaQueue) park(ctx context.Context, msg *Message) error {
+	return q.write(ctx, kafkaDeadTopic, msg.Body, msg.Headers)
+}
+
+func (q *KafkaQueue) write(ctx context.Context, topic string, body []byte, headers map[string]interface{}) error {
+	return q.writer.WriteMessages(ctx, kafka.Message{
+		Topic:   topic,
+		Key:     []byte(recipientKey(body)),
+		Value:   body,
+		Headers: toKafkaHeaders(headers),
+	})
+}
+
+// Depths reports the consumer group lag of each ready topic, the lag summed
+// over the retry topics as the delayed messages, and the messages kept on the
+// dead letter topic, which no group reads.
+func (q *KafkaQueue) Depths(ctx context.Context) (map[string]int64, error) {
+	client := &kafka.Client{Addr: kafka.TCP(q.brokers...)}
+
+	depths := make(map[string]int64)
+	for _, priority := range models.Priorities {
+		topic := kafkaReadyPrefix + string(priority)
+		lag, err := kafkaTopicDepth(ctx, client, topic, kafkaGroupPrefix+topic)
+		if err != nil {
+			return nil, err
+		}
+		depths["ready."+string(priority)] = lag
+	}
+	for level := range retryLevels {
+		topic := kafkaRetryTopic(level)
+		lag, err := kafkaTopicDepth(ctx, client, topic, kafkaGroupPrefix+topic)
+		if err != nil {
+			return nil, err
+		}
+		depths["delayed"] += lag
+	}
+	dead, err := kafkaTopicDepth(ctx, client, kafkaDeadTopic, "")
+	if err != nil {
+		return nil, err
+	}
+	depths["dead"] = dead
+	return depths, nil
+}
+
+// kafkaTopicDepth sums the lag of group over the topic's partitions, or counts
+// every retained message when group is empty.
+func kafkaTopicDepth(ctx context.Context, client *kafka.Client, topic, group string) (int64, error) {
+	metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read metadata of %s: %w", topic, err)
+	}
+	if len(metadata.Topics) != 1 || metadata.Topics[0].Error != nil {
+		return 0, fmt.Errorf("failed to read metadata of %s: %v", topic, metadata.Topics)
+	}
+
+	var partitions []int
+	var requests []kafka.OffsetRequest
+	for _, partition := range metadata.Topics[0].Partitions {
+		partitions = append(partitions, partition.ID)
+		requests = append(requests, kafka.FirstOffsetOf(partition.ID), kafka.LastOffsetOf(partition.ID))
+	}
+
+	listed, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: requests},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list offsets of %s: %w", topic, err)
+	}
+
+	committed := make(map[int]int64)
+	if group != "" {
+		fetched, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+			GroupID: group,
+			Topics:  map[string][]int{topic: partitions},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch offsets of group %s: %w", group, err)
+		}
+		if fetched.Error != nil {
+			return 0, fmt.Errorf("failed to fetch offsets of group %s: %w", group, fetched.Error)
+		}
+		for _, partition := range fetched.Topics[topic] {
+			if partition.Error == nil {
+				committed[partition.Partition] = partition.CommittedOffset
+			}
+		}
+	}
+
+	var depth int64
+	for _, partition := range listed.Topics[topic] {
+		if partition.Error != nil {
+			return 0, fmt.Errorf("failed to list offsets of %s/%d: %w", topic, partition.Partition, partition.Error)
+		}
+		next, ok := committed[partition.Partition]
+		if !ok {
+			next = -1
+		}
+		depth += kafkaLag(partition.FirstOffset, partition.LastOffset, next)
+	}
+	return depth, nil
+}
+
+// kafkaLag counts the messages between the group's committed offset and the
+// end of the partition. Without a commit, or with one that retention has
+// passed, the readers start at the first retained message.
+func kafkaLag(first, last, committed int64) int64 {
+	if committed < first {
+		committed = first
+	}
+	return max(last-committed, 0)
+}
+
+// Ping connects to the first broker that answers.
+func (q *KafkaQueue) Ping(ctx context.Context) error {
+	var err error
+	for _, broker := range q.brokers {
+		var conn *kafka.Conn
+		if conn, err = kafka.DialContext(ctx, "tcp", broker); err == nil {
+			return conn.Close()
+		}
+	}
+	return fmt.Errorf("failed to connect to Kafka: %w", err)
+}
+
+func (q *KafkaQueue) ConsumersRunning() error {
+	return q.running.check()
+}
+
+func (q *KafkaQueue) Close() error {
+	q.mu.Lock()
+	readers := q.readers
+	q.readers = nil
+	q.mu.Unlock()
+
+	for _, reader := range readers {
+		if err := reader.Close(); err != nil {
+			slog.Error("Failed to close reader", "topic", reader.Config().Topic, logging.KeyError, err)
+		}
+	}
+	return q.writer.Close()
+}
+
+// recipientKey partitions messages by tenant and recipient, falling back to
+// the notification ID for bodies without a recipient.
+func recipientKey(body []byte) string {
+	var notification models.Notification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		return ""
+	}
+	if notification.Recipient == "" {
+		return notification.ID
+	}
+	return notification.TenantID + ":" + notification.Recipient
+}
+
+// Kafka header values are bytes, so values are formatted on the way out and
+// read back as strings, as for NATS.
+func toKafkaHeaders(headers map[string]interface{}) []kafka.Header {
+	converted := make([]kafka.Header, 0, len(headers))
+	for k, v := range headers {
+		converted = append(converted, kafka.Header{Key: k, Value: []byte(fmt.Sprint(v))})
+	}
+	return converted
+}
+
+func fromKafkaMessage(m kafka.Message) *Message {
+	msg := &Message{Body: m.Value, Headers: map[string]interface{}{}}
+	for _, h := range m.Headers {
+		msg.Headers[h.Key] = string(h.Value)
+	}
+	return msg
+}
@@ -0,0 +1,22 @@
+package queue
+
+import "testing"
+
+func TestKafkaLag(t *testing.T) {
+	tests := []struct {
+		name                   string
+		first, last, committed int64
+		want                   int64
+	}{
+		{name: "caught up", first: 0, last: 10, committed: 10, want: 0},
+		{name: "behind", first: 0, last: 10, committed: 4, want: 6},
+		{name: "never committed", first: 0, last: 10, committed: -1, want: 10},
+		{name: "commit passed by retention", first: 8, last: 10, committed: 3, want: 2},
+		{name: "empty partition", first: 5, last: 5, committed: -1, want: 0},
+	}
+	for _, tt := range tests {
+		if got := kafkaLag(tt.first, tt.last, tt.committed); got != tt.want {
+			t.Errorf("%s: kafkaLag(%d, %d, %d) = %d, want %d", tt.name, tt.first, tt.last, tt.committed, got, tt.want)
+		}
+	}
+}
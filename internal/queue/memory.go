@@ -0,0 +1,288 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/tracing"
+)
+
+const memoryQueueSize = 1024
+
+// MemoryQueue is an in-process queue backed by channels, one per priority.
+// It is meant for tests and for running the API and worker in one binary;
+// messages do not survive a restart.
+type MemoryQueue struct {
+	ready  map[models.Priority]chan *Message
+	mu     sync.Mutex
+	timers map[*time.Timer]struct{}
+	dead   []*Message
+	closed chan struct{}
+	once   sync.Once
+
+	concurrency Concurrency
+	running     consumerTracker
+}
+
+func NewMemoryQueue(concurrency Concurrency) *MemoryQueue {
+	q := &MemoryQueue{
+		ready:       make(map[models.Priority]chan *Message),
+		timers:      make(map[*time.Timer]struct{}),
+		closed:      make(chan struct{}),
+		concurrency: concurrency,
+	}
+	for _, priority := range models.Priorities {
+		q.ready[priority] = make(chan *Message, memoryQueueSize)
+	}
+	slog.Info("In-memory queue initialized successfully")
+	return q
+}
+
+func (q *MemoryQueue) PublishDelayed(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendMemory, "PublishDelayed", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	delay := calculateDelay(notification.DueAt())
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.redeliver(ctx, msg, string(priorityOf(notification)), delay); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Published notification", logging.KeyNotificationID, notification.ID, "delay", delay)
+	return nil
+}
+
+func (q *MemoryQueue) PublishImmediate(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendMemory, "PublishImmediate", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.push(ctx, msg, string(priorityOf(notification))); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Published immediate notification", logging.KeyNotificationID, notification.ID)
+	return nil
+}
+
+// Consume starts workers as set by the queue's Concurrency. Each worker
+// prefers the most urgent priority that has a message waiting.
+func (q *MemoryQueue) Consume(ctx context.Context, handler Handler) error {
+	for _, priority := range models.Priorities {
+		guarded := guard(handler, q, string(priority))
+		for i := 0; i < q.concurrency.consumers(priority); i++ {
+			q.running.goConsume(func() { q.work(ctx, guarded) })
+		}
+	}
+
+	slog.Info("Consumers started successfully")
+	return nil
+}
+
+func (q *MemoryQueue) work(ctx context.Context, handler Handler) {
+	for {
+		msg, ok := q.next(ctx)
+		if !ok {
+			return
+		}
+		if err := handler(ctx, msg); err != nil {
+			slog.ErrorContext(ctx, "Failed to settle message, redelivering", logging.KeyError, err)
+			var notification models.Notification
+			_ = json.Unmarshal(msg.Body, &notification)
+			_ = q.push(ctx, msg, string(priorityOf(&notification)))
+		}
+	}
+}
+
+func (q *MemoryQueue) next(ctx context.Context) (*Message, bool) {
+	for _, priority := range models.Priorities {
+		select {
+		case msg := <-q.ready[priority]:
+			return msg, true
+		default:
+		}
+	}
+
+	select {
+	case msg := <-q.ready[models.PriorityCritical]:
+		return msg, true
+	case msg := <-q.ready[models.PriorityHigh]:
+		return msg, true
+	case msg := <-q.ready[models.PriorityNormal]:
+		return msg, true
+	case msg := <-q.ready[models.PriorityLow]:
+		return msg, true
+	case <-q.closed:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+func (q *MemoryQueue) push(ctx context.Context, msg *Message, destination string) error {
+	ready, ok := q.ready[models.Priority(destination)]
+	if !ok {
+		ready = q.ready[models.PriorityNormal]
+	}
+
+	select {
+	case ready <- msg:
+		return nil
+	case <-q.closed:
+		return fmt.Errorf("queue closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *MemoryQueue) redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error {
+	if delay <= 0 {
+		return q.push(ctx, msg, destination)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		delete(q.timers, timer)
+		q.mu.Unlock()
+
+		if err := q.push(context.Background(), msg, destination); err != nil {
+			slog.Error("Failed to deliver delayed message", logging.KeyError, err)
+		}
+	})
+	q.timers[timer] = struct{}{}
+	return nil
+}
+
+func (q *MemoryQueue) park(ctx context.Context, msg *Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.dead = append(q.dead, msg)
+	return nil
+}
+
+func (q *MemoryQueue) ListDeadLetters(ctx context.Context, tenantID string, limit int) ([]DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var letters []DeadLetter
+	for _, msg := range q.dead {
+		if limit > 0 && len(letters) >= limit {
+			break
+		}
+		if letterTenant(msg.Headers) == tenantID {
+			letters = append(letters, toDeadLetter(msg))
+		}
+	}
+	return letters, nil
+}
+
+func (q *MemoryQueue) GetDeadLetter(ctx context.Context, tenantID, id string) (*DeadLetter, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if i := q.findDead(tenantID, id); i >= 0 {
+		letter := toDeadLetter(q.dead[i])
+		return &letter, nil
+	}
+	return nil, nil
+}
+
+func (q *MemoryQueue) ReplayDeadLetter(ctx context.Context, tenantID, id string) (bool, error) {
+	q.mu.Lock()
+	i := q.findDead(tenantID, id)
+	if i < 0 {
+		q.mu.Unlock()
+		return false, nil
+	}
+	msg := q.dead[i]
+	q.dead = append(q.dead[:i], q.dead[i+1:]...)
+	q.mu.Unlock()
+
+	destination, revived := revive(msg)
+	return true, q.push(ctx, revived, destination)
+}
+
+func (q *MemoryQueue) PurgeDeadLetters(ctx context.Context, tenantID string) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	kept := q.dead[:0]
+	for _, msg := range q.dead {
+		if letterTenant(msg.Headers) != tenantID {
+			kept = append(kept, msg)
+		}
+	}
+	purged := len(q.dead) - len(kept)
+	q.dead = kept
+	return purged, nil
+}
+
+func (q *MemoryQueue) findDead(tenantID, id string) int {
+	for i, msg := range q.dead {
+		if msg.Headers[headerDeadLetterID] == id && letterTenant(msg.Headers) == tenantID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *MemoryQueue) Depths(ctx context.Context) (map[string]int64, error) {
+	depths := make(map[string]int64)
+	for priority, ready := range q.ready {
+		depths["ready."+string(priority)] = int64(len(ready))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	depths["delayed"] = int64(len(q.timers))
+	depths["dead"] = int64(len(q.dead))
+	return depths, nil
+}
+
+func (q *MemoryQueue) Ping(ctx context.Context) error {
+	select {
+	case <-q.closed:
+		return errors.New("queue is closed")
+	default:
+		return nil
+	}
+}
+
+func (q *MemoryQueue) ConsumersRunning() error {
+	return q.running.check()
+}
+
+func (q *MemoryQueue) Close() error {
+	q.once.Do(func() {
+		close(q.closed)
+
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for timer := range q.timers {
+			timer.Stop()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,585 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/tracing"
+)
+
+const (
+	natsStream         = "NOTIFICATIONS"
+	natsDelayStream    = "NOTIFICATIONS_DELAY"
+	natsDeadStream     = "NOTIFICATIONS_DEAD"
+	natsReadyPrefix    = "notifications.ready."
+	natsDelayPrefix    = "notifications.delay."
+	natsDeadSubject    = "notifications.dead"
+	natsConsumerPrefix = "notifier-"
+	natsAckWait        = 2 * time.Minute
+	natsForwardRetry   = time.Second
+)
+
+// natsMaxDeliver is the server-side ceiling on deliveries. guard parks
+// messages well before it; the ceiling only catches messages that are never
+// settled, such as ones that crash the worker, and those are dead-lettered
+// from the max-deliveries advisory.
+const natsMaxDeliver = 2 * maxDeliveries
+
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries int    `json:"deliveries"`
+}
+
+// NATSQueue keeps the ready messages in a work-queue stream with one subject
+// and durable consumer per priority. Delayed messages and retries wait on the
+// delay subjects, one per retry level, rather than being Nak'd with a delay:
+// a Nak'd message stays pending on the ready consumer, and enough of them
+// reach MaxAckPending and stall the messages that are due.
+type NATSQueue struct {
+	conn        *nats.Conn
+	js          jetstream.JetStream
+	stream      jetstream.Stream
+	delayStream jetstream.Stream
+	deadStream  jetstream.Stream
+
+	concurrency Concurrency
+
+	mu         sync.Mutex
+	consumers  []jetstream.ConsumeContext
+	advisories *nats.Subscription
+}
+
+func NewNATSQueue(url string, concurrency Concurrency) (*NATSQueue, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("notifier"),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(2*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create JetStream context: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      natsStream,
+		Subjects:  []string{natsReadyPrefix + ">"},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create stream %s: %w", natsStream, err)
+	}
+
+	delayStream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      natsDelayStream,
+		Subjects:  []string{natsDelayPrefix + ">"},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create stream %s: %w", natsDelayStream, err)
+	}
+
+	deadStream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     natsDeadStream,
+		Subjects: []string{natsDeadSubject},
+		Storage:  jetstream.FileStorage,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create stream %s: %w", natsDeadStream, err)
+	}
+
+	slog.Info("NATS JetStream queue initialized successfully")
+	return &NATSQueue{
+		conn:        conn,
+		js:          js,
+		stream:      stream,
+		delayStream: delayStream,
+		deadStream:  deadStream,
+
+		concurrency: concurrency,
+	}, nil
+}
+
+func (q *NATSQueue) PublishDelayed(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendNATS, "PublishDelayed", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	delay := calculateDelay(notification.DueAt())
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.redeliver(ctx, msg, string(priorityOf(notification)), delay); err != nil {
+		return fmt.Errorf("failed to publish notification: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Published notification", logging.KeyNotificationID, notification.ID, "delay", delay)
+	return nil
+}
+
+func (q *NATSQueue) PublishImmediate(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendNATS, "PublishImmediate", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.publish(ctx, natsReadyPrefix+string(priorityOf(notification)), msg); err != nil {
+		return fmt.Errorf("failed to publish notification: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Published immediate notification", logging.KeyNotificationID, notification.ID)
+	return nil
+}
+
+// publish waits for the stream's ack, the JetStream counterpart of a
+// publisher confirm.
+func (q *NATSQueue) publish(ctx context.Context, subject string, msg *Message) error {
+	_, err := q.js.PublishMsg(ctx, &nats.Msg{
+		Subject: subject,
+		Data:    msg.Body,
+		Header:  toNATSHeader(msg.Headers),
+	})
+	return err
+}
+
+func (q *NATSQueue) Consume(ctx context.Context, handler Handler) error {
+	sub, err := q.conn.QueueSubscribe(
+		"$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES."+natsStream+".>",
+		natsConsumerPrefix+"advisories",
+		func(m *nats.Msg) { q.deadLetterExhausted(ctx, m) },
+	)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to max deliveries advisories: %w", err)
+	}
+
+	q.mu.Lock()
+	q.advisories = sub
+	q.mu.Unlock()
+
+	for _, priority := range models.Priorities {
+		consumer, err := q.stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       natsConsumerPrefix + string(priority),
+			FilterSubject: natsReadyPrefix + string(priority),
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       natsAckWait,
+			MaxDeliver:    natsMaxDeliver,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %s consumer: %w", priority, err)
+		}
+
+		destination := string(priority)
+		workers := make(chan struct{}, q.concurrency.consumers(priority))
+		consumeCtx, err := consumer.Consume(func(m jetstream.Msg) {
+			workers <- struct{}{}
+			go func() {
+				defer func() { <-workers }()
+				q.handle(ctx, m, handler, destination)
+			}()
+		}, jetstream.PullMaxMessages(q.concurrency.prefetch(priority)))
+		if err != nil {
+			return fmt.Errorf("failed to start %s consumer: %w", priority, err)
+		}
+
+		q.mu.Lock()
+		q.consumers = append(q.consumers, consumeCtx)
+		q.mu.Unlock()
+	}
+
+	for level := range retryLevels {
+		// With one message pending the consumer only ever holds the head of
+		// its level, which is due first.
+		consumer, err := q.delayStream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+			Durable:       natsDelayConsumer(level),
+			FilterSubject: natsDelaySubject(level),
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       natsAckWait,
+			MaxAckPending: 1,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create %s consumer: %w", natsDelaySubject(level), err)
+		}
+
+		consumeCtx, err := consumer.Consume(func(m jetstream.Msg) {
+			q.forward(ctx, m)
+		}, jetstream.PullMaxMessages(1))
+		if err != nil {
+			return fmt.Errorf("failed to start %s consumer: %w", natsDelaySubject(level), err)
+		}
+
+		q.mu.Lock()
+		q.consumers = append(q.consumers, consumeCtx)
+		q.mu.Unlock()
+	}
+
+	go func() {
+		<-ctx.Done()
+		q.stopConsuming()
+	}()
+
+	slog.Info("Consumers started successfully")
+	return nil
+}
+
+func (q *NATSQueue) handle(ctx context.Context, m jetstream.Msg, handler Handler, destination string) {
+	msg := fromNATSMsg(m.Headers(), m.Data())
+
+	delivery := &natsDelivery{queue: q, msg: m}
+	if err := guard(handler, delivery, destination)(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "Failed to settle message, redelivering", "subject", m.Subject(), logging.KeyError, err)
+		_ = m.Nak()
+		return
+	}
+
+	if !delivery.settled {
+		if err := m.Ack(); err != nil {
+			slog.ErrorContext(ctx, "Failed to ack message", "subject", m.Subject(), logging.KeyError, err)
+		}
+	}
+}
+
+// natsDelivery settles a single in-flight message: redeliveries and parked
+// messages are published again, carrying guard's delivery count in the
+// headers, before the original is acked.
+type natsDelivery struct {
+	queue   *NATSQueue
+	msg     jetstream.Msg
+	settled bool
+}
+
+func (d *natsDelivery) redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error {
+	return d.queue.redeliver(ctx, msg, destination, delay)
+}
+
+func (d *natsDelivery) park(ctx context.Context, msg *Message) error {
+	return d.queue.park(ctx, msg)
+}
+
+func (q *NATSQueue) park(ctx context.Context, msg *Message) error {
+	return q.publish(ctx, natsDeadSubject, msg)
+}
+
+// forward moves a delay-level message on once its level delay has passed: to
+// the next level if the message is still not due, else to its ready subject.
+// Until then it is Nak'd with the rest of the level delay, which keeps it
+// pending and the rest of the level behind it.
+func (q *NATSQueue) forward(ctx context.Context, m jetstream.Msg) {
+	msg := fromNATSMsg(m.Headers(), m.Data())
+
+	if due, ok := headerTime(msg.Headers, headerLevelDue); ok && time.Now().Before(due) {
+		if err := m.NakWithDelay(time.Until(due)); err != nil {
+			slog.ErrorContext(ctx, "Failed to delay message", "subject", m.Subject(), logging.KeyError, err)
+		}
+		return
+	}
+
+	destination, _ := msg.Headers[headerRetryTarget].(string)
+	if destination == "" {
+		destination = string(models.PriorityNormal)
+	}
+
+	var remaining time.Duration
+	if until, ok := headerTime(msg.Headers, headerNotBefore); ok {
+		remaining = time.Until(until)
+	}
+	if err := q.redeliver(ctx, msg, destination, remaining); err != nil {
+		slog.ErrorContext(ctx, "Failed to forward delayed message", "subject", m.Subject(), logging.KeyError, err)
+		_ = m.NakWithDelay(natsForwardRetry)
+		return
+	}
+	if err := m.Ack(); err != nil {
+		slog.ErrorContext(ctx, "Failed to ack delayed message", "subject", m.Subject(), logging.KeyError, err)
+	}
+}
+
+// redeliver publishes the message to the delay level for its delay, or
+// straight to its ready subject once it is due.
+func (q *NATSQueue) redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error {
+	headers := copyHeaders(msg.Headers)
+	delete(headers, headerLevelDue)
+
+	subject := natsReadyPrefix + destination
+	if delay > 0 {
+		level := retryLevel(delay)
+		subject = natsDelaySubject(level)
+		headers[headerNotBefore] = time.Now().Add(delay).UnixMilli()
+		headers[headerLevelDue] = time.Now().Add(retryLevels[level]).UnixMilli()
+		headers[headerRetryTarget] = destination
+	} else {
+		delete(headers, headerNotBefore)
+		delete(headers, headerRetryTarget)
+	}
+
+	if err := q.publish(ctx, subject, &Message{Body: msg.Body, Headers: headers}); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+	return nil
+}
+
+func natsDelaySubject(level int) string {
+	return fmt.Sprintf("%s%ds", natsDelayPrefix, int(retryLevels[level].Seconds()))
+}
+
+func natsDelayConsumer(level int) string {
+	return fmt.Sprintf("%sdelay-%ds", natsConsumerPrefix, int(retryLevels[level].Seconds()))
+}
+
+// deadLetterExhausted parks a message that hit the consumer's MaxDeliver
+// without being settled and removes it from the work queue.
+func (q *NATSQueue) deadLetterExhausted(ctx context.Context, m *nats.Msg) {
+	var advisory maxDeliveriesAdvisory
+	if err := json.Unmarshal(m.Data, &advisory); err != nil {
+		slog.ErrorContext(ctx, "Error unmarshalling max deliveries advisory", logging.KeyError, err)
+		return
+	}
+
+	raw, err := q.stream.GetMsg(ctx, advisory.StreamSeq)
+	if err != nil {
+		if !errors.Is(err, jetstream.ErrMsgNotFound) {
+			slog.ErrorContext(ctx, "Failed to load exhausted message", "stream_seq", advisory.StreamSeq, logging.KeyError, err)
+		}
+		return
+	}
+
+	msg := fromNATSMsg(raw.Header, raw.Data)
+	msg.Headers[headerDeliveryCount] = advisory.Deliveries
+	markDead(msg, strings.TrimPrefix(raw.Subject, natsReadyPrefix),
+		fmt.Errorf("exceeded %d deliveries without being settled", advisory.Deliveries))
+
+	if err := q.park(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "Failed to dead-letter exhausted message", "stream_seq", advisory.StreamSeq, logging.KeyError, err)
+		return
+	}
+	if err := q.stream.DeleteMsg(ctx, advisory.StreamSeq); err != nil && !errors.Is(err, jetstream.ErrMsgNotFound) {
+		slog.ErrorContext(ctx, "Failed to remove exhausted message", "stream_seq", advisory.StreamSeq, logging.KeyError, err)
+	}
+
+	slog.WarnContext(ctx, "Message dead-lettered after exceeding max deliveries",
+		"dead_letter_id", msg.Headers[headerDeadLetterID], "deliveries", advisory.Deliveries)
+}
+
+func (q *NATSQueue) ListDeadLetters(ctx context.Context, tenantID string, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.scanDeadLetters(ctx, func(_ uint64, msg *Message) bool {
+		if letterTenant(msg.Headers) == tenantID {
+			letters = append(letters, toDeadLetter(msg))
+		}
+		return limit > 0 && len(letters) >= limit
+	})
+	return letters, err
+}
+
+func (q *NATSQueue) GetDeadLetter(ctx context.Context, tenantID, id string) (*DeadLetter, error) {
+	_, msg, err := q.findDead(ctx, tenantID, id)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	letter := toDeadLetter(msg)
+	return &letter, nil
+}
+
+func (q *NATSQueue) ReplayDeadLetter(ctx context.Context, tenantID, id string) (bool, error) {
+	seq, msg, err := q.findDead(ctx, tenantID, id)
+	if err != nil || msg == nil {
+		return false, err
+	}
+
+	destination, revived := revive(msg)
+	if destination == "" {
+		destination = string(models.PriorityNormal)
+	}
+	if err := q.publish(ctx, natsReadyPrefix+destination, revived); err != nil {
+		return false, fmt.Errorf("failed to replay dead letter: %w", err)
+	}
+
+	if err := q.deadStream.DeleteMsg(ctx, seq); err != nil {
+		return true, fmt.Errorf("failed to remove replayed dead letter: %w", err)
+	}
+	return true, nil
+}
+
+func (q *NATSQueue) PurgeDeadLetters(ctx context.Context, tenantID string) (int, error) {
+	var seqs []uint64
+	err := q.scanDeadLetters(ctx, func(seq uint64, msg *Message) bool {
+		if letterTenant(msg.Headers) == tenantID {
+			seqs = append(seqs, seq)
+		}
+		return false
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, seq := range seqs {
+		if err := q.deadStream.DeleteMsg(ctx, seq); err != nil {
+			return purged, fmt.Errorf("failed to purge dead letters: %w", err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+func (q *NATSQueue) findDead(ctx context.Context, tenantID, id string) (uint64, *Message, error) {
+	var (
+		found    uint64
+		foundMsg *Message
+	)
+	err := q.scanDeadLetters(ctx, func(seq uint64, msg *Message) bool {
+		if msg.Headers[headerDeadLetterID] == id && letterTenant(msg.Headers) == tenantID {
+			found, foundMsg = seq, msg
+			return true
+		}
+		return false
+	})
+	return found, foundMsg, err
+}
+
+// scanDeadLetters walks the dead letter stream by sequence, skipping
+// messages that were deleted, until visit returns true.
+func (q *NATSQueue) scanDeadLetters(ctx context.Context, visit func(seq uint64, msg *Message) bool) error {
+	info, err := q.deadStream.Info(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+
+	for seq := info.State.FirstSeq; seq <= info.State.LastSeq; seq++ {
+		raw, err := q.deadStream.GetMsg(ctx, seq)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read dead letter %d: %w", seq, err)
+		}
+		if visit(seq, fromNATSMsg(raw.Header, raw.Data)) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Depths counts the messages stored per priority subject, the delayed
+// messages waiting on the delay levels and the dead letters.
+func (q *NATSQueue) Depths(ctx context.Context) (map[string]int64, error) {
+	info, err := q.stream.Info(ctx, jetstream.WithSubjectFilter(natsReadyPrefix+">"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream %s info: %w", natsStream, err)
+	}
+	delayInfo, err := q.delayStream.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream %s info: %w", natsDelayStream, err)
+	}
+	deadInfo, err := q.deadStream.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream %s info: %w", natsDeadStream, err)
+	}
+
+	depths := map[string]int64{
+		"delayed": int64(delayInfo.State.Msgs),
+		"dead":    int64(deadInfo.State.Msgs),
+	}
+	for _, priority := range models.Priorities {
+		depths["ready."+string(priority)] = int64(info.State.Subjects[natsReadyPrefix+string(priority)])
+	}
+	return depths, nil
+}
+
+// Ping makes a round trip to the server.
+func (q *NATSQueue) Ping(ctx context.Context) error {
+	if !q.conn.IsConnected() {
+		return fmt.Errorf("NATS connection is %s", q.conn.Status())
+	}
+	return q.conn.FlushWithContext(ctx)
+}
+
+func (q *NATSQueue) ConsumersRunning() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.consumers) == 0 {
+		return errors.New("no consumers started")
+	}
+	stopped := 0
+	for _, consumer := range q.consumers {
+		select {
+		case <-consumer.Closed():
+			stopped++
+		default:
+		}
+	}
+	if stopped > 0 {
+		return fmt.Errorf("%d of %d consumers stopped", stopped, len(q.consumers))
+	}
+	return nil
+}
+
+func (q *NATSQueue) stopConsuming() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, consumer := range q.consumers {
+		consumer.Stop()
+	}
+	q.consumers = nil
+
+	if q.advisories != nil {
+		_ = q.advisories.Unsubscribe()
+		q.advisories = nil
+	}
+}
+
+func (q *NATSQueue) Close() error {
+	q.stopConsuming()
+	return q.conn.Drain()
+}
+
+// NATS headers are strings, so values are formatted on the way out and read
+// back as strings; deliveryCount accepts both.
+func toNATSHeader(headers map[string]interface{}) nats.Header {
+	header := nats.Header{}
+	for k, v := range headers {
+		header.Set(k, fmt.Sprint(v))
+	}
+	return header
+}
+
+func fromNATSMsg(header nats.Header, data []byte) *Message {
+	msg := &Message{Body: data, Headers: map[string]interface{}{}}
+	for k := range header {
+		msg.Headers[k] = header.Get(k)
+	}
+	return msg
+}
@@ -0,0 +1,269 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats-server/v2/test"
+	"notifier/internal/models"
+)
+
+func newTestNATSQueue(t *testing.T) *NATSQueue {
+	t.Helper()
+
+	opts := test.DefaultTestOptions
+	opts.Port = server.RANDOM_PORT
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := test.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+
+	q, err := NewNATSQueue(srv.ClientURL(), Concurrency{Workers: 1})
+	if err != nil {
+		t.Fatalf("NewNATSQueue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+func consumeNATS(t *testing.T, q *NATSQueue, handler Handler) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := q.Consume(ctx, handler); err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+}
+
+// waitForDeadLetter polls the dead letter stream until the tenant's letter
+// shows up.
+func waitForDeadLetter(t *testing.T, q *NATSQueue, tenantID string, timeout time.Duration) DeadLetter {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		letters, err := q.ListDeadLetters(context.Background(), tenantID, 0)
+		if err != nil {
+			t.Fatalf("ListDeadLetters: %v", err)
+		}
+		if len(letters) > 0 {
+			return letters[0]
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("no dead letter for tenant %s after %v", tenantID, timeout)
+	return DeadLetter{}
+}
+
+// waitForReadyEmpty polls until every message has been acked or removed
+// from the work queue.
+func waitForReadyEmpty(t *testing.T, q *NATSQueue, timeout time.Duration) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		depths, err := q.Depths(context.Background())
+		if err != nil {
+			t.Fatalf("Depths: %v", err)
+		}
+		var ready int64
+		for _, priority := range models.Priorities {
+			ready += depths["ready."+string(priority)]
+		}
+		if ready == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages still ready after %v", ready, timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestNATSDelayedPublishIsHeldBackUntilDue(t *testing.T) {
+	q := newTestNATSQueue(t)
+
+	type delivery struct {
+		at    time.Time
+		count int
+	}
+	delivered := make(chan delivery, 1)
+	consumeNATS(t, q, func(ctx context.Context, msg *Message) error {
+		delivered <- delivery{at: time.Now(), count: deliveryCount(msg.Headers)}
+		return nil
+	})
+
+	sendAt := time.Now().Add(1500 * time.Millisecond)
+	notification := &models.Notification{ID: "delayed", TenantID: "acme", SendAt: sendAt}
+	if err := q.PublishDelayed(context.Background(), notification); err != nil {
+		t.Fatalf("PublishDelayed: %v", err)
+	}
+
+	select {
+	case d := <-delivered:
+		// The not-before header has millisecond precision.
+		if d.at.Before(sendAt.Truncate(time.Millisecond)) {
+			t.Errorf("delivered %v before it was due", sendAt.Sub(d.at))
+		}
+		if d.count != 0 {
+			t.Errorf("delivery count = %d, want 0: the held back delivery is not an attempt", d.count)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("delayed message was never delivered")
+	}
+}
+
+// More messages wait out a delay than a consumer may have pending (the
+// server's default MaxAckPending is 1000); due messages still flow past them.
+func TestNATSDelayedMessagesDoNotStallDueOnes(t *testing.T) {
+	q := newTestNATSQueue(t)
+
+	const waiting = 1500
+	sendAt := time.Now().Add(time.Hour)
+	for i := 0; i < waiting; i++ {
+		notification := &models.Notification{ID: fmt.Sprintf("later-%d", i), TenantID: "acme", SendAt: sendAt}
+		if err := q.PublishDelayed(context.Background(), notification); err != nil {
+			t.Fatalf("PublishDelayed: %v", err)
+		}
+	}
+
+	delivered := make(chan string, waiting+1)
+	consumeNATS(t, q, func(ctx context.Context, msg *Message) error {
+		var notification models.Notification
+		if err := json.Unmarshal(msg.Body, &notification); err != nil {
+			return err
+		}
+		delivered <- notification.ID
+		return nil
+	})
+
+	due := &models.Notification{ID: "due", TenantID: "acme"}
+	if err := q.PublishImmediate(context.Background(), due); err != nil {
+		t.Fatalf("PublishImmediate: %v", err)
+	}
+
+	select {
+	case id := <-delivered:
+		if id != due.ID {
+			t.Errorf("delivered %s, want %s: it was not due for an hour", id, due.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("due message was stalled behind the delayed ones")
+	}
+
+	depths, err := q.Depths(context.Background())
+	if err != nil {
+		t.Fatalf("Depths: %v", err)
+	}
+	if depths["delayed"] != waiting {
+		t.Errorf("delayed depth = %d, want %d", depths["delayed"], waiting)
+	}
+}
+
+func TestNATSGuardRedeliversFailuresWithDelay(t *testing.T) {
+	q := newTestNATSQueue(t)
+
+	type delivery struct {
+		at    time.Time
+		count int
+	}
+	delivered := make(chan delivery, 2)
+	consumeNATS(t, q, func(ctx context.Context, msg *Message) error {
+		delivered <- delivery{at: time.Now(), count: deliveryCount(msg.Headers)}
+		if deliveryCount(msg.Headers) == 0 {
+			return errors.New("destination unavailable")
+		}
+		return nil
+	})
+
+	notification := &models.Notification{ID: "flaky", TenantID: "acme"}
+	if err := q.PublishImmediate(context.Background(), notification); err != nil {
+		t.Fatalf("PublishImmediate: %v", err)
+	}
+
+	var got []delivery
+	for len(got) < 2 {
+		select {
+		case d := <-delivered:
+			got = append(got, d)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d deliveries, want 2", len(got))
+		}
+	}
+	// guard backs off 2s after the first failure.
+	if gap := got[1].at.Sub(got[0].at); gap < 2*time.Second {
+		t.Errorf("redelivered after %v, want at least 2s", gap)
+	}
+	if got[1].count != 1 {
+		t.Errorf("delivery count on redelivery = %d, want 1", got[1].count)
+	}
+	waitForReadyEmpty(t, q, 5*time.Second)
+}
+
+func TestNATSGuardParksPoisonMessages(t *testing.T) {
+	q := newTestNATSQueue(t)
+
+	consumeNATS(t, q, func(ctx context.Context, msg *Message) error {
+		return ErrPoisonMessage
+	})
+
+	notification := &models.Notification{ID: "poison", TenantID: "acme", Priority: models.PriorityHigh}
+	if err := q.PublishImmediate(context.Background(), notification); err != nil {
+		t.Fatalf("PublishImmediate: %v", err)
+	}
+
+	letter := waitForDeadLetter(t, q, "acme", 10*time.Second)
+	if letter.RoutingKey != string(models.PriorityHigh) {
+		t.Errorf("routing key = %q, want %q", letter.RoutingKey, models.PriorityHigh)
+	}
+	if letter.Deliveries != 1 {
+		t.Errorf("deliveries = %d, want 1", letter.Deliveries)
+	}
+	if !strings.Contains(letter.Reason, ErrPoisonMessage.Error()) {
+		t.Errorf("reason = %q, want it to mention %q", letter.Reason, ErrPoisonMessage)
+	}
+	waitForReadyEmpty(t, q, 5*time.Second)
+}
+
+func TestNATSDeadLettersMessagesExceedingMaxDeliveries(t *testing.T) {
+	q := newTestNATSQueue(t)
+
+	var mu sync.Mutex
+	deliveries := 0
+	// An interrupted delivery is nacked without being counted by guard, so
+	// only the server's MaxDeliver stops it.
+	consumeNATS(t, q, func(ctx context.Context, msg *Message) error {
+		mu.Lock()
+		deliveries++
+		mu.Unlock()
+		return ErrInterrupted
+	})
+
+	notification := &models.Notification{ID: "stuck", TenantID: "acme"}
+	if err := q.PublishImmediate(context.Background(), notification); err != nil {
+		t.Fatalf("PublishImmediate: %v", err)
+	}
+
+	letter := waitForDeadLetter(t, q, "acme", 20*time.Second)
+	if letter.Deliveries != natsMaxDeliver {
+		t.Errorf("deliveries = %d, want %d", letter.Deliveries, natsMaxDeliver)
+	}
+	if !strings.Contains(letter.Reason, "exceeded") {
+		t.Errorf("reason = %q, want the max deliveries reason", letter.Reason)
+	}
+
+	mu.Lock()
+	if deliveries != natsMaxDeliver {
+		t.Errorf("handler saw %d deliveries, want %d", deliveries, natsMaxDeliver)
+	}
+	mu.Unlock()
+	waitForReadyEmpty(t, q, 5*time.Second)
+}
@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/wb-go/wbf/rabbitmq"
+	"github.com/wb-go/wbf/retry"
+)
+
+var ErrPublishNacked = errors.New("publish was nacked by the broker")
+
+// confirmPublisher mirrors rabbitmq.Publisher but publishes persistent
+// messages on a channel in confirm mode and only returns once the broker has
+// acked them, so a nil error means the message is safely enqueued. The
+// channel is kept open and shared by concurrent publishes, and reopened once
+// the broker or a reconnect closes it.
+type confirmPublisher struct {
+	client      *rabbitmq.RabbitClient
+	exchange    string
+	contentType string
+	strategy    retry.Strategy
+
+	mu      sync.Mutex
+	channel *amqp091.Channel
+	closed  chan *amqp091.Error
+}
+
+func newConfirmPublisher(client *rabbitmq.RabbitClient, exchange, contentType string, strategy retry.Strategy) *confirmPublisher {
+	return &confirmPublisher{
+		client:      client,
+		exchange:    exchange,
+		contentType: contentType,
+		strategy:    strategy,
+	}
+}
+
+func (p *confirmPublisher) Publish(ctx context.Context, body []byte, routingKey string, opts ...rabbitmq.PublishOption) error {
+	return retry.DoContext(ctx, p.strategy, func() error {
+		ch, err := p.confirmChannel()
+		if err != nil {
+			return err
+		}
+
+		pub := amqp091.Publishing{
+			ContentType:  p.contentType,
+			DeliveryMode: amqp091.Persistent,
+			Body:         body,
+		}
+		for _, opt := range opts {
+			opt(&pub)
+		}
+
+		confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, p.exchange, routingKey, false, false, pub)
+		if err != nil {
+			p.discard(ch)
+			return err
+		}
+
+		acked, err := confirmation.WaitContext(ctx)
+		if err != nil {
+			return err
+		}
+		if !acked {
+			return ErrPublishNacked
+		}
+		return nil
+	})
+}
+
+// confirmChannel returns the open confirm channel, opening a new one if the
+// last was closed.
+func (p *confirmPublisher) confirmChannel() (*amqp091.Channel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel != nil {
+		select {
+		case <-p.closed:
+			p.channel = nil
+		default:
+			return p.channel, nil
+		}
+	}
+
+	ch, err := p.client.GetChannel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	p.channel = ch
+	p.closed = ch.NotifyClose(make(chan *amqp091.Error, 1))
+	return ch, nil
+}
+
+// discard closes ch after a failed publish so the next one opens a fresh
+// channel, unless another publish has replaced it already.
+func (p *confirmPublisher) discard(ch *amqp091.Channel) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel == ch {
+		p.channel = nil
+	}
+	ch.Close()
+}
+
+// Close closes the confirm channel, if one is open.
+func (p *confirmPublisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel != nil {
+		p.channel.Close()
+		p.channel = nil
+	}
+}
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/wb-go/wbf/retry"
+	"notifier/internal/models"
+)
+
+// Message is a delivery handed to a Handler, independent of the broker.
+type Message struct {
+	Body    []byte
+	Headers map[string]interface{}
+}
+
+// RequestID returns the ID of the API request that led to the message, if
+// there was one.
+func (m *Message) RequestID() string {
+	id, _ := m.Headers[headerRequestID].(string)
+	return id
+}
+
+// Handler processes a message. Returning nil acknowledges it; errors are
+// settled by the queue as described on guard.
+type Handler func(ctx context.Context, msg *Message) error
+
+type Queue interface {
+	PublishDelayed(ctx context.Context, notification *models.Notification) error
+	PublishImmediate(ctx context.Context, notification *models.Notification) error
+	Consume(ctx context.Context, handler Handler) error
+	Close() error
+}
+
+// DeadLetters is implemented by queues that can list and replay the
+// messages they parked.
+type DeadLetters interface {
+	ListDeadLetters(ctx context.Context, tenantID string, limit int) ([]DeadLetter, error)
+	GetDeadLetter(ctx context.Context, tenantID, id string) (*DeadLetter, error)
+	ReplayDeadLetter(ctx context.Context, tenantID, id string) (bool, error)
+	PurgeDeadLetters(ctx context.Context, tenantID string) (int, error)
+}
+
+// Depths is implemented by queues that can report how many messages are
+// waiting, keyed by queue name.
+type Depths interface {
+	Depths(ctx context.Context) (map[string]int64, error)
+}
+
+// Health is implemented by queues that can check their broker connection
+// and whether the consumers started by Consume are still running.
+type Health interface {
+	Ping(ctx context.Context) error
+	ConsumersRunning() error
+}
+
+const (
+	BackendRabbitMQ     = "rabbitmq"
+	BackendMemory       = "memory"
+	BackendRedisStreams = "redis"
+	BackendNATS         = "nats"
+	BackendKafka        = "kafka"
+)
+
+type Config struct {
+	Backend  string
+	AMQPURL  string
+	RedisURL string
+	NATSURL  string
+
+	KafkaBrokers []string
+
+	Concurrency Concurrency
+	AMQPRetry   AMQPRetry
+}
+
+// Concurrency sets how many consumers each priority gets: Workers times the
+// priority's weight in consumerWeights. Prefetch caps the deliveries a
+// RabbitMQ or NATS consumer holds unacknowledged; zero means one per
+// consumer.
+type Concurrency struct {
+	Workers  int
+	Prefetch int
+}
+
+func (c Concurrency) consumers(priority models.Priority) int {
+	return consumerWeights[priority] * max(c.Workers, 1)
+}
+
+func (c Concurrency) prefetch(priority models.Priority) int {
+	if c.Prefetch > 0 {
+		return c.Prefetch
+	}
+	return c.consumers(priority)
+}
+
+// AMQPRetry holds the RabbitMQ client's retry strategies for reconnecting,
+// publishing and consuming.
+type AMQPRetry struct {
+	Reconnect retry.Strategy
+	Publish   retry.Strategy
+	Consume   retry.Strategy
+}
+
+var DefaultAMQPRetry = AMQPRetry{
+	Reconnect: retry.Strategy{Attempts: 10, Delay: 2 * time.Second, Backoff: 2},
+	Publish:   retry.Strategy{Attempts: 3, Delay: 100 * time.Millisecond, Backoff: 2},
+	Consume:   retry.Strategy{Attempts: 3, Delay: 100 * time.Millisecond, Backoff: 2},
+}
+
+func New(cfg Config) (Queue, error) {
+	switch cfg.Backend {
+	case BackendRabbitMQ:
+		return NewRabbitQueue(cfg.AMQPURL, cfg.Concurrency, cfg.AMQPRetry)
+	case BackendMemory:
+		return NewMemoryQueue(cfg.Concurrency), nil
+	case BackendRedisStreams:
+		return NewRedisStreamsQueue(cfg.RedisURL, cfg.Concurrency)
+	case BackendNATS:
+		return NewNATSQueue(cfg.NATSURL, cfg.Concurrency)
+	case BackendKafka:
+		return NewKafkaQueue(cfg.KafkaBrokers, cfg.Concurrency)
+	default:
+		return nil, fmt.Errorf("unknown queue backend %q", cfg.Backend)
+	}
+}
+
+// retryLevels are the fixed delays of the Kafka retry topics and the NATS
+// delay subjects. Every message on a level waits the same time, so each level
+// stays ordered by due time and its consumer only ever waits on the head.
+// Longer delays hop through the levels until the remaining delay is used up.
+var retryLevels = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	time.Hour,
+}
+
+// retryLevel picks the longest level that does not overshoot the delay, or
+// the shortest one for delays below it. A message therefore hops down the
+// levels and is delivered less than the shortest level, one second, after it
+// is due; delays under a second are rounded up to a second.
+func retryLevel(delay time.Duration) int {
+	level := 0
+	for i, d := range retryLevels {
+		if d <= delay {
+			level = i
+		}
+	}
+	return level
+}
+
+func calculateDelay(sendAt time.Time) time.Duration {
+	now := time.Now()
+	if sendAt.Before(now) {
+		return 0
+	}
+	return sendAt.Sub(now)
+}
+
+func priorityOf(notification *models.Notification) models.Priority {
+	if notification.Priority == "" {
+		return models.PriorityNormal
+	}
+	return notification.Priority
+}
@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryLevel(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  time.Duration
+	}{
+		{delay: 300 * time.Millisecond, want: time.Second},
+		{delay: time.Second, want: time.Second},
+		{delay: 4999 * time.Millisecond, want: time.Second},
+		{delay: 5 * time.Second, want: 5 * time.Second},
+		{delay: 90 * time.Second, want: 30 * time.Second},
+		{delay: 3 * time.Hour, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryLevels[retryLevel(tt.delay)]; got != tt.want {
+			t.Errorf("retryLevel(%v) waits %v, want %v", tt.delay, got, tt.want)
+		}
+	}
+}
+
+// Hopping down the levels never delivers early, and late by less than the
+// shortest level.
+func TestRetryLevelsOvershootByLessThanTheShortestLevel(t *testing.T) {
+	for _, delay := range []time.Duration{
+		time.Millisecond,
+		300 * time.Millisecond,
+		time.Second,
+		1500 * time.Millisecond,
+		7 * time.Second,
+		2*time.Minute + 31*time.Second + 250*time.Millisecond,
+		25 * time.Hour,
+	} {
+		var waited time.Duration
+		for remaining := delay; remaining > 0; {
+			level := retryLevels[retryLevel(remaining)]
+			waited += level
+			remaining -= level
+		}
+		if waited < delay || waited-delay >= retryLevels[0] {
+			t.Errorf("delay %v: delivered after %v", delay, waited)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rabbitmq/amqp091-go"
+	"github.com/wb-go/wbf/rabbitmq"
+)
+
+const (
+	deadLetterExchange = "notifications.dead"
+	deadLetterQueue    = "notifications.dead"
+)
+
+func setupDeadLetters(client *rabbitmq.RabbitClient) error {
+	err := client.DeclareExchange(deadLetterExchange, "fanout", true, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter exchange: %w", err)
+	}
+
+	err = client.DeclareQueue(deadLetterQueue, deadLetterExchange, "", true, false, true, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter queue: %w", err)
+	}
+
+	return nil
+}
+
+func (q *RabbitQueue) redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error {
+	opts := []rabbitmq.PublishOption{rabbitmq.WithHeaders(msg.Headers)}
+
+	var err error
+	if delay <= 0 {
+		err = q.publisher.Publish(ctx, msg.Body, destination, opts...)
+	} else {
+		err = q.delayPublisher.Publish(ctx, msg.Body, delayRoutingKey(delay, destination), opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to republish delivery: %w", err)
+	}
+	return nil
+}
+
+func (q *RabbitQueue) park(ctx context.Context, msg *Message) error {
+	id, _ := msg.Headers[headerDeadLetterID].(string)
+	return q.deadPublisher.Publish(ctx, msg.Body, "", rabbitmq.WithHeaders(msg.Headers), withMessageID(id))
+}
+
+func (q *RabbitQueue) ListDeadLetters(ctx context.Context, tenantID string, limit int) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := q.scanDeadLetters(func(delivery amqp091.Delivery) (bool, bool, error) {
+		if letterTenant(delivery.Headers) == tenantID {
+			letters = append(letters, toDeadLetter(fromDelivery(delivery)))
+		}
+		return false, limit > 0 && len(letters) >= limit, nil
+	})
+	return letters, err
+}
+
+func (q *RabbitQueue) GetDeadLetter(ctx context.Context, tenantID, id string) (*DeadLetter, error) {
+	var letter *DeadLetter
+	err := q.scanDeadLetters(func(delivery amqp091.Delivery) (bool, bool, error) {
+		if delivery.MessageId != id || letterTenant(delivery.Headers) != tenantID {
+			return false, false, nil
+		}
+		found := toDeadLetter(fromDelivery(delivery))
+		letter = &found
+		return false, true, nil
+	})
+	return letter, err
+}
+
+func (q *RabbitQueue) ReplayDeadLetter(ctx context.Context, tenantID, id string) (bool, error) {
+	var replayed bool
+	err := q.scanDeadLetters(func(delivery amqp091.Delivery) (bool, bool, error) {
+		if delivery.MessageId != id || letterTenant(delivery.Headers) != tenantID {
+			return false, false, nil
+		}
+
+		destination, msg := revive(fromDelivery(delivery))
+		if destination == "" {
+			destination = routingKey("ready", "")
+		}
+		if err := q.publisher.Publish(ctx, msg.Body, destination, rabbitmq.WithHeaders(msg.Headers)); err != nil {
+			return false, true, fmt.Errorf("failed to replay dead letter: %w", err)
+		}
+
+		replayed = true
+		return true, true, nil
+	})
+	return replayed, err
+}
+
+func (q *RabbitQueue) PurgeDeadLetters(ctx context.Context, tenantID string) (int, error) {
+	var purged int
+	err := q.scanDeadLetters(func(delivery amqp091.Delivery) (bool, bool, error) {
+		if letterTenant(delivery.Headers) != tenantID {
+			return false, false, nil
+		}
+		purged++
+		return true, false, nil
+	})
+	return purged, err
+}
+
+// scanDeadLetters walks the dead letter queue on a private channel. Messages
+// the visitor acks are removed; all others are requeued when the channel is
+// closed.
+func (q *RabbitQueue) scanDeadLetters(visit func(amqp091.Delivery) (ack bool, stop bool, err error)) error {
+	ch, err := q.client.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer ch.Close()
+
+	for {
+		delivery, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return fmt.Errorf("failed to read dead letter queue: %w", err)
+		}
+		if !ok {
+			return nil
+		}
+
+		ack, stop, err := visit(delivery)
+		if ack {
+			if ackErr := delivery.Ack(false); ackErr != nil {
+				return fmt.Errorf("failed to ack dead letter: %w", ackErr)
+			}
+		}
+		if err != nil || stop {
+			return err
+		}
+	}
+}
+
+func fromDelivery(delivery amqp091.Delivery) *Message {
+	return &Message{
+		Body:    delivery.Body,
+		Headers: delivery.Headers,
+	}
+}
+
+func withMessageID(id string) rabbitmq.PublishOption {
+	return func(p *amqp091.Publishing) {
+		p.MessageId = id
+	}
+}
@@ -3,40 +3,35 @@ package queue
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
+	"github.com/rabbitmq/amqp091-go"
 	"github.com/wb-go/wbf/rabbitmq"
-	"github.com/wb-go/wbf/retry"
+	"notifier/internal/logging"
 	"notifier/internal/models"
+	"notifier/internal/tracing"
 )
 
-type Manager struct {
-	client    *rabbitmq.RabbitClient
-	publisher *rabbitmq.Publisher
-	consumer  *rabbitmq.Consumer
+type RabbitQueue struct {
+	client         *rabbitmq.RabbitClient
+	publisher      *confirmPublisher
+	delayPublisher *confirmPublisher
+	deadPublisher  *confirmPublisher
+	consumers      []*rabbitmq.Consumer
+	concurrency    Concurrency
+	running        consumerTracker
 }
 
-func NewManager(url string) (*Manager, error) {
+func NewRabbitQueue(url string, concurrency Concurrency, retries AMQPRetry) (*RabbitQueue, error) {
 	config := rabbitmq.ClientConfig{
-		URL:       url,
-		Heartbeat: 10 * time.Second,
-		ReconnectStrat: retry.Strategy{
-			Attempts: 10,
-			Delay:    2 * time.Second,
-			Backoff:  2,
-		},
-		ProducingStrat: retry.Strategy{
-			Attempts: 3,
-			Delay:    100 * time.Millisecond,
-			Backoff:  2,
-		},
-		ConsumingStrat: retry.Strategy{
-			Attempts: 3,
-			Delay:    100 * time.Millisecond,
-			Backoff:  2,
-		},
+		URL:            url,
+		Heartbeat:      10 * time.Second,
+		ReconnectStrat: retries.Reconnect,
+		ProducingStrat: retries.Publish,
+		ConsumingStrat: retries.Consume,
 	}
 
 	client, err := rabbitmq.NewClient(config)
@@ -49,145 +44,228 @@ func NewManager(url string) (*Manager, error) {
 		return nil, fmt.Errorf("failed to setup exchanges and queues: %w", err)
 	}
 
-	publisher := rabbitmq.NewPublisher(client, "notifications", "application/json")
+	publisher := newConfirmPublisher(client, "notifications", "application/json", config.ProducingStrat)
+	delayPublisher := newConfirmPublisher(client, delayTopExchange(), "application/json", config.ProducingStrat)
+	deadPublisher := newConfirmPublisher(client, deadLetterExchange, "application/json", config.ProducingStrat)
 
-	log.Println("RabbitMQ manager initialized successfully")
-	return &Manager{
-		client:    client,
-		publisher: publisher,
+	slog.Info("RabbitMQ queue initialized successfully")
+	return &RabbitQueue{
+		client:         client,
+		publisher:      publisher,
+		delayPublisher: delayPublisher,
+		deadPublisher:  deadPublisher,
+		concurrency:    concurrency,
 	}, nil
 }
 
+// consumerWeights sets how many workers per Concurrency.Workers consume each
+// priority's ready queue, so urgent messages are picked up first when the
+// queues back up.
+var consumerWeights = map[models.Priority]int{
+	models.PriorityCritical: 4,
+	models.PriorityHigh:     3,
+	models.PriorityNormal:   2,
+	models.PriorityLow:      1,
+}
+
+// Normal priority keeps the original queue names and routing keys so that
+// messages published before priorities existed are still consumed.
+func routingKey(kind string, priority models.Priority) string {
+	if priority == "" || priority == models.PriorityNormal {
+		return kind
+	}
+	return kind + "." + string(priority)
+}
+
+func queueName(kind string, priority models.Priority) string {
+	return "notifications." + routingKey(kind, priority)
+}
+
 func setupExchangesAndQueues(client *rabbitmq.RabbitClient) error {
 	err := client.DeclareExchange("notifications", "direct", true, false, false, nil)
 	if err != nil {
 		return fmt.Errorf("failed to declare exchange: %w", err)
 	}
 
-	delayQueueArgs := map[string]interface{}{
-		"x-dead-letter-exchange":    "notifications",
-		"x-dead-letter-routing-key": "ready",
-		"x-message-ttl":             60000,
+	if err := setupDelayLevels(client); err != nil {
+		return err
 	}
 
-	err = client.DeclareQueue(
-		"notifications.delayed",
-		"notifications",
-		"delayed",
-		true,
-		false,
-		true,
-		delayQueueArgs,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare delayed queue: %w", err)
-	}
-
-	err = client.DeclareQueue(
-		"notifications.ready",
-		"notifications",
-		"ready",
-		true,
-		false,
-		true,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare ready queue: %w", err)
+	if err := setupDeadLetters(client); err != nil {
+		return err
+	}
+
+	for _, priority := range models.Priorities {
+		err = client.DeclareQueue(
+			queueName("ready", priority),
+			"notifications",
+			routingKey("ready", priority),
+			true,
+			false,
+			true,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare %s ready queue: %w", priority, err)
+		}
+
+		err = client.DeclareQueue(
+			queueName("ready", priority),
+			delayDeliverExchange,
+			"#."+routingKey("ready", priority),
+			true,
+			false,
+			true,
+			nil,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to bind %s ready queue to delay levels: %w", priority, err)
+		}
 	}
 
 	return nil
 }
 
-func (m *Manager) PublishDelayed(ctx context.Context, notification *models.Notification) error {
+func (q *RabbitQueue) PublishDelayed(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendRabbitMQ, "PublishDelayed", notification)
+	defer func() { tracing.End(span, err) }()
+
 	body, err := json.Marshal(notification)
 	if err != nil {
 		return fmt.Errorf("failed to marshal notification: %w", err)
 	}
 
-	delay := calculateDelay(notification.SendAt)
-
-	if delay > 60*time.Second {
-		log.Printf("Notification %s has long delay %v, will be handled by scheduler",
-			notification.ID, delay)
-		return nil
-	}
-
-	var routingKey string
-	var opts []rabbitmq.PublishOption
+	delay := calculateDelay(notification.DueAt())
+	key := routingKey("ready", notification.Priority)
 
 	if delay <= 0 {
-		routingKey = "ready"
+		err = q.publisher.Publish(ctx, body, key, rabbitmq.WithHeaders(headers))
 	} else {
-		routingKey = "delayed"
-		opts = append(opts, rabbitmq.WithExpiration(delay))
+		key = delayRoutingKey(delay, key)
+		err = q.delayPublisher.Publish(ctx, body, key, rabbitmq.WithHeaders(headers))
 	}
-
-	err = m.publisher.Publish(ctx, body, routingKey, opts...)
 	if err != nil {
 		return fmt.Errorf("failed to publish notification: %w", err)
 	}
 
-	log.Printf("Published notification %s with routing key %s, delay %v",
-		notification.ID, routingKey, delay)
+	slog.InfoContext(ctx, "Published notification",
+		logging.KeyNotificationID, notification.ID, "routing_key", key, "delay", delay)
 	return nil
 }
 
-func (m *Manager) PublishImmediate(ctx context.Context, notification *models.Notification) error {
+func (q *RabbitQueue) PublishImmediate(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendRabbitMQ, "PublishImmediate", notification)
+	defer func() { tracing.End(span, err) }()
+
 	body, err := json.Marshal(notification)
 	if err != nil {
 		return fmt.Errorf("failed to marshal notification: %w", err)
 	}
 
-	err = m.publisher.Publish(ctx, body, "ready")
+	err = q.publisher.Publish(ctx, body, routingKey("ready", notification.Priority), rabbitmq.WithHeaders(headers))
 	if err != nil {
 		return fmt.Errorf("failed to publish notification: %w", err)
 	}
 
-	log.Printf("Published immediate notification %s", notification.ID)
+	slog.InfoContext(ctx, "Published immediate notification", logging.KeyNotificationID, notification.ID)
 	return nil
 }
 
-func (m *Manager) StartConsumer(ctx context.Context, handler rabbitmq.MessageHandler) error {
-	config := rabbitmq.ConsumerConfig{
-		Queue:         "notifications.ready",
-		ConsumerTag:   "notifications-consumer",
-		AutoAck:       false,
-		Workers:       3,
-		PrefetchCount: 10,
-		Ask: rabbitmq.AskConfig{
-			Multiple: false,
-		},
-		Nack: rabbitmq.NackConfig{
-			Multiple: false,
-			Requeue:  true,
-		},
-		Args: nil,
-	}
-
-	m.consumer = rabbitmq.NewConsumer(m.client, config, handler)
-
-	go func() {
-		if err := m.consumer.Start(ctx); err != nil {
-			log.Printf("Consumer stopped with error: %v", err)
+func (q *RabbitQueue) Consume(ctx context.Context, handler Handler) error {
+	for _, priority := range models.Priorities {
+		config := rabbitmq.ConsumerConfig{
+			Queue:         queueName("ready", priority),
+			ConsumerTag:   "notifications-consumer-" + string(priority),
+			AutoAck:       false,
+			Workers:       q.concurrency.consumers(priority),
+			PrefetchCount: q.concurrency.prefetch(priority),
+			Ask: rabbitmq.AskConfig{
+				Multiple: false,
+			},
+			Nack: rabbitmq.NackConfig{
+				Multiple: false,
+				Requeue:  true,
+			},
+			Args: nil,
 		}
-	}()
 
-	log.Println("Consumer started successfully")
+		guarded := guard(handler, q, routingKey("ready", priority))
+		consumer := rabbitmq.NewConsumer(q.client, config, func(ctx context.Context, delivery amqp091.Delivery) error {
+			return guarded(ctx, fromDelivery(delivery))
+		})
+		q.consumers = append(q.consumers, consumer)
+
+		q.running.goConsume(func() {
+			if err := consumer.Start(ctx); err != nil {
+				slog.ErrorContext(ctx, "Consumer stopped with error", "consumer", config.ConsumerTag, logging.KeyError, err)
+			}
+		})
+	}
+
+	slog.Info("Consumers started successfully")
 	return nil
 }
 
-func (m *Manager) Close() error {
-	if m.client != nil {
-		return m.client.Close()
+// Depths reports the ready messages per priority, the messages waiting on
+// any delay level and the dead letters.
+func (q *RabbitQueue) Depths(ctx context.Context) (map[string]int64, error) {
+	ch, err := q.client.GetChannel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
 	}
-	return nil
+	defer ch.Close()
+
+	messages := func(name string) (int64, error) {
+		queue, err := ch.QueueDeclarePassive(name, true, false, false, false, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to inspect queue %s: %w", name, err)
+		}
+		return int64(queue.Messages), nil
+	}
+
+	depths := make(map[string]int64)
+	for _, priority := range models.Priorities {
+		if depths["ready."+string(priority)], err = messages(queueName("ready", priority)); err != nil {
+			return nil, err
+		}
+	}
+	for level := 0; level < delayLevels; level++ {
+		n, err := messages(delayLevelName(level))
+		if err != nil {
+			return nil, err
+		}
+		depths["delayed"] += n
+	}
+	if depths["dead"], err = messages(deadLetterQueue); err != nil {
+		return nil, err
+	}
+	return depths, nil
 }
 
-func calculateDelay(sendAt time.Time) time.Duration {
-	now := time.Now()
-	if sendAt.Before(now) {
-		return 0
+// Ping checks that the connection is up and can open a channel.
+func (q *RabbitQueue) Ping(ctx context.Context) error {
+	if !q.client.Healthy() {
+		return errors.New("AMQP connection is closed")
+	}
+	ch, err := q.client.GetChannel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
 	}
-	return sendAt.Sub(now)
+	return ch.Close()
+}
+
+func (q *RabbitQueue) ConsumersRunning() error {
+	return q.running.check()
+}
+
+func (q *RabbitQueue) Close() error {
+	for _, publisher := range []*confirmPublisher{q.publisher, q.delayPublisher, q.deadPublisher} {
+		if publisher != nil {
+			publisher.Close()
+		}
+	}
+	if q.client != nil {
+		return q.client.Close()
+	}
+	return nil
 }
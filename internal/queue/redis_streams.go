@@ -0,0 +1,421 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	wbfredis "github.com/wb-go/wbf/redis"
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/tracing"
+)
+
+const (
+	streamPrefix       = "queue:ready:"
+	streamDelayedKey   = "queue:delayed"
+	streamDeadKey      = "queue:dead"
+	streamGroup        = "notifier"
+	streamBlock        = time.Second
+	streamMoveInterval = 250 * time.Millisecond
+	streamClaimIdle    = time.Minute
+)
+
+// moveDueScript moves due entries from the delayed sorted set onto their
+// ready stream in one step, so concurrent movers never duplicate them.
+var moveDueScript = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, item in ipairs(items) do
+	local entry = cjson.decode(item)
+	redis.call('XADD', ARGV[2] .. entry.destination, '*', 'body', entry.body, 'headers', entry.headers)
+	redis.call('ZREM', KEYS[1], item)
+end
+return #items
+`)
+
+type delayedEntry struct {
+	Destination string `json:"destination"`
+	Body        string `json:"body"`
+	Headers     string `json:"headers"`
+	Nonce       int64  `json:"nonce"`
+}
+
+// RedisStreamsQueue keeps one stream per priority consumed through a
+// consumer group. Delays live in a sorted set scored by due time and are
+// moved onto the streams by every consuming worker.
+type RedisStreamsQueue struct {
+	client      *redis.Client
+	consumer    string
+	concurrency Concurrency
+	running     consumerTracker
+}
+
+func NewRedisStreamsQueue(addr string, concurrency Concurrency) (*RedisStreamsQueue, error) {
+	client := wbfredis.New(addr, "", 0).Client
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	for _, priority := range models.Priorities {
+		err := client.XGroupCreateMkStream(ctx, streamPrefix+string(priority), streamGroup, "0").Err()
+		if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
+			return nil, fmt.Errorf("failed to create consumer group for %s: %w", priority, err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	slog.Info("Redis Streams queue initialized successfully")
+	return &RedisStreamsQueue{
+		client:      client,
+		consumer:    fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+		concurrency: concurrency,
+	}, nil
+}
+
+func (q *RedisStreamsQueue) PublishDelayed(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendRedisStreams, "PublishDelayed", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	delay := calculateDelay(notification.DueAt())
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.redeliver(ctx, msg, string(priorityOf(notification)), delay); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Published notification", logging.KeyNotificationID, notification.ID, "delay", delay)
+	return nil
+}
+
+func (q *RedisStreamsQueue) PublishImmediate(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span, headers := startPublish(ctx, BackendRedisStreams, "PublishImmediate", notification)
+	defer func() { tracing.End(span, err) }()
+
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	msg := &Message{Body: body, Headers: headers}
+	if err := q.redeliver(ctx, msg, string(priorityOf(notification)), 0); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Published immediate notification", logging.KeyNotificationID, notification.ID)
+	return nil
+}
+
+func (q *RedisStreamsQueue) Consume(ctx context.Context, handler Handler) error {
+	q.running.goConsume(func() { q.moveDue(ctx) })
+
+	for _, priority := range models.Priorities {
+		stream := streamPrefix + string(priority)
+		guarded := guard(handler, q, string(priority))
+		for i := 0; i < q.concurrency.consumers(priority); i++ {
+			q.running.goConsume(func() { q.work(ctx, stream, guarded) })
+		}
+		q.running.goConsume(func() { q.reclaim(ctx, stream, guarded) })
+	}
+
+	slog.Info("Consumers started successfully")
+	return nil
+}
+
+func (q *RedisStreamsQueue) work(ctx context.Context, stream string, handler Handler) {
+	for ctx.Err() == nil {
+		streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    streamGroup,
+			Consumer: q.consumer,
+			Streams:  []string{stream, ">"},
+			Count:    1,
+			Block:    streamBlock,
+		}).Result()
+		if err != nil {
+			if err != redis.Nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to read from stream", "stream", stream, logging.KeyError, err)
+				time.Sleep(streamBlock)
+			}
+			continue
+		}
+
+		for _, s := range streams {
+			for _, entry := range s.Messages {
+				q.handle(ctx, stream, entry, handler)
+			}
+		}
+	}
+}
+
+// reclaim takes over entries left pending by consumers that died or failed
+// to settle them.
+func (q *RedisStreamsQueue) reclaim(ctx context.Context, stream string, handler Handler) {
+	ticker := time.NewTicker(streamClaimIdle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending, err := q.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  streamGroup,
+			Idle:   streamClaimIdle,
+			Start:  "-",
+			End:    "+",
+			Count:  100,
+		}).Result()
+		if err != nil || len(pending) == 0 {
+			continue
+		}
+
+		ids := make([]string, 0, len(pending))
+		for _, p := range pending {
+			ids = append(ids, p.ID)
+		}
+
+		entries, err := q.client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    streamGroup,
+			Consumer: q.consumer,
+			MinIdle:  streamClaimIdle,
+			Messages: ids,
+		}).Result()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to claim pending entries", "stream", stream, logging.KeyError, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			q.handle(ctx, stream, entry, handler)
+		}
+	}
+}
+
+func (q *RedisStreamsQueue) handle(ctx context.Context, stream string, entry redis.XMessage, handler Handler) {
+	if err := handler(ctx, toMessage(entry)); err != nil {
+		slog.ErrorContext(ctx, "Failed to settle entry, leaving it pending", "stream", stream, "entry", entry.ID, logging.KeyError, err)
+		return
+	}
+
+	pipe := q.client.TxPipeline()
+	pipe.XAck(ctx, stream, streamGroup, entry.ID)
+	pipe.XDel(ctx, stream, entry.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.ErrorContext(ctx, "Failed to ack entry", "stream", stream, "entry", entry.ID, logging.KeyError, err)
+	}
+}
+
+func (q *RedisStreamsQueue) moveDue(ctx context.Context) {
+	ticker := time.NewTicker(streamMoveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := moveDueScript.Run(ctx, q.client, []string{streamDelayedKey},
+				time.Now().UnixMilli(), streamPrefix).Err()
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to move due messages", logging.KeyError, err)
+			}
+		}
+	}
+}
+
+func (q *RedisStreamsQueue) redeliver(ctx context.Context, msg *Message, destination string, delay time.Duration) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal headers: %w", err)
+	}
+
+	if delay <= 0 {
+		err = q.client.XAdd(ctx, &redis.XAddArgs{
+			Stream: streamPrefix + destination,
+			Values: map[string]interface{}{"body": msg.Body, "headers": headers},
+		}).Err()
+		if err != nil {
+			return fmt.Errorf("failed to publish message: %w", err)
+		}
+		return nil
+	}
+
+	entry, err := json.Marshal(delayedEntry{
+		Destination: destination,
+		Body:        string(msg.Body),
+		Headers:     string(headers),
+		Nonce:       time.Now().UnixNano(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal delayed message: %w", err)
+	}
+
+	err = q.client.ZAdd(ctx, streamDelayedKey, &redis.Z{
+		Score:  float64(time.Now().Add(delay).UnixMilli()),
+		Member: entry,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to publish delayed message: %w", err)
+	}
+	return nil
+}
+
+func (q *RedisStreamsQueue) park(ctx context.Context, msg *Message) error {
+	headers, err := json.Marshal(msg.Headers)
+	if err != nil {
+		return fmt.Errorf("failed to marshal headers: %w", err)
+	}
+
+	return q.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: streamDeadKey,
+		Values: map[string]interface{}{"body": msg.Body, "headers": headers},
+	}).Err()
+}
+
+func (q *RedisStreamsQueue) ListDeadLetters(ctx context.Context, tenantID string, limit int) ([]DeadLetter, error) {
+	entries, err := q.client.XRange(ctx, streamDeadKey, "-", "+").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	var letters []DeadLetter
+	for _, entry := range entries {
+		if limit > 0 && len(letters) >= limit {
+			break
+		}
+		msg := toMessage(entry)
+		if letterTenant(msg.Headers) == tenantID {
+			letters = append(letters, toDeadLetter(msg))
+		}
+	}
+	return letters, nil
+}
+
+func (q *RedisStreamsQueue) GetDeadLetter(ctx context.Context, tenantID, id string) (*DeadLetter, error) {
+	_, msg, err := q.findDead(ctx, tenantID, id)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+	letter := toDeadLetter(msg)
+	return &letter, nil
+}
+
+func (q *RedisStreamsQueue) ReplayDeadLetter(ctx context.Context, tenantID, id string) (bool, error) {
+	entryID, msg, err := q.findDead(ctx, tenantID, id)
+	if err != nil || msg == nil {
+		return false, err
+	}
+
+	destination, revived := revive(msg)
+	if destination == "" {
+		destination = string(models.PriorityNormal)
+	}
+	if err := q.redeliver(ctx, revived, destination, 0); err != nil {
+		return false, fmt.Errorf("failed to replay dead letter: %w", err)
+	}
+
+	if err := q.client.XDel(ctx, streamDeadKey, entryID).Err(); err != nil {
+		return true, fmt.Errorf("failed to remove replayed dead letter: %w", err)
+	}
+	return true, nil
+}
+
+func (q *RedisStreamsQueue) PurgeDeadLetters(ctx context.Context, tenantID string) (int, error) {
+	entries, err := q.client.XRange(ctx, streamDeadKey, "-", "+").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if letterTenant(toMessage(entry).Headers) == tenantID {
+			ids = append(ids, entry.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	purged, err := q.client.XDel(ctx, streamDeadKey, ids...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge dead letters: %w", err)
+	}
+	return int(purged), nil
+}
+
+func (q *RedisStreamsQueue) findDead(ctx context.Context, tenantID, id string) (string, *Message, error) {
+	entries, err := q.client.XRange(ctx, streamDeadKey, "-", "+").Result()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	for _, entry := range entries {
+		msg := toMessage(entry)
+		if msg.Headers[headerDeadLetterID] == id && letterTenant(msg.Headers) == tenantID {
+			return entry.ID, msg, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// Depths counts the entries on each ready stream, which includes entries
+// being handled, since acknowledged entries are deleted.
+func (q *RedisStreamsQueue) Depths(ctx context.Context) (map[string]int64, error) {
+	pipe := q.client.Pipeline()
+	ready := make(map[models.Priority]*redis.IntCmd, len(models.Priorities))
+	for _, priority := range models.Priorities {
+		ready[priority] = pipe.XLen(ctx, streamPrefix+string(priority))
+	}
+	delayed := pipe.ZCard(ctx, streamDelayedKey)
+	dead := pipe.XLen(ctx, streamDeadKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to get queue depths: %w", err)
+	}
+
+	depths := map[string]int64{
+		"delayed": delayed.Val(),
+		"dead":    dead.Val(),
+	}
+	for priority, cmd := range ready {
+		depths["ready."+string(priority)] = cmd.Val()
+	}
+	return depths, nil
+}
+
+func (q *RedisStreamsQueue) Ping(ctx context.Context) error {
+	return q.client.Ping(ctx).Err()
+}
+
+func (q *RedisStreamsQueue) ConsumersRunning() error {
+	return q.running.check()
+}
+
+func (q *RedisStreamsQueue) Close() error {
+	return q.client.Close()
+}
+
+func toMessage(entry redis.XMessage) *Message {
+	msg := &Message{Headers: map[string]interface{}{}}
+	if body, ok := entry.Values["body"].(string); ok {
+		msg.Body = []byte(body)
+	}
+	if headers, ok := entry.Values["headers"].(string); ok {
+		_ = json.Unmarshal([]byte(headers), &msg.Headers)
+	}
+	return msg
+}
@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/tracing"
+)
+
+var tracer = tracing.Tracer("notifier/queue")
+
+// startPublish starts the producer span of a publish and returns the
+// message headers that carry its W3C trace context and request ID to the
+// consumer. Redeliveries copy the headers, so retries stay in the same trace.
+func startPublish(ctx context.Context, backend, operation string, notification *models.Notification) (context.Context, trace.Span, map[string]interface{}) {
+	ctx, span := tracer.Start(ctx, "queue."+operation,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", backend),
+			attribute.String("notification.id", notification.ID),
+			attribute.String("notification.priority", string(priorityOf(notification))),
+			attribute.String("tenant.id", notification.TenantID),
+		),
+	)
+
+	headers := map[string]interface{}{}
+	tracing.Inject(ctx, tracing.Headers(headers))
+	if id := logging.RequestID(ctx); id != "" {
+		headers[headerRequestID] = id
+	}
+	return ctx, span, headers
+}
@@ -0,0 +1,70 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"notifier/internal/logging"
+	"notifier/internal/storage"
+	"notifier/internal/tenant"
+)
+
+const createdCounter = "created"
+
+var (
+	ErrPendingExceeded = errors.New("pending notifications quota exceeded")
+	ErrRateExceeded    = errors.New("notifications per minute quota exceeded")
+)
+
+type Enforcer struct {
+	storage  storage.Storage
+	registry *tenant.Registry
+}
+
+func NewEnforcer(storage storage.Storage, registry *tenant.Registry) *Enforcer {
+	return &Enforcer{
+		storage:  storage,
+		registry: registry,
+	}
+}
+
+// CheckCreate is called by the API before a notification is accepted for the
+// tenant in ctx. The returned refund gives back the notification's place in
+// the per-minute quota and must be called if it is not created after all.
+func (e *Enforcer) CheckCreate(ctx context.Context) (refund func(context.Context), err error) {
+	refund = func(context.Context) {}
+	quota := e.registry.Quota(tenant.FromContext(ctx))
+
+	if quota.MaxPending > 0 {
+		pending, err := e.storage.CountPending(ctx)
+		if err != nil {
+			return refund, fmt.Errorf("failed to count pending notifications: %w", err)
+		}
+		if pending >= int64(quota.MaxPending) {
+			return refund, ErrPendingExceeded
+		}
+	}
+
+	if quota.SendsPerMinute > 0 {
+		countedAt := time.Now()
+		created, err := e.storage.IncrementCounter(ctx, createdCounter, time.Minute)
+		if err != nil {
+			return refund, fmt.Errorf("failed to count created notifications: %w", err)
+		}
+		refund = func(ctx context.Context) {
+			if err := e.storage.DecrementCounter(ctx, createdCounter, time.Minute, countedAt); err != nil {
+				slog.ErrorContext(ctx, "Failed to refund created notifications quota", logging.KeyError, err)
+			}
+		}
+		// A rejected notification is not counted either.
+		if created > int64(quota.SendsPerMinute) {
+			refund(ctx)
+			return func(context.Context) {}, ErrRateExceeded
+		}
+	}
+
+	return refund, nil
+}
@@ -0,0 +1,190 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	wbfredis "github.com/wb-go/wbf/redis"
+	"notifier/internal/models"
+	"notifier/internal/tenant"
+)
+
+// takeScript refills every bucket from its own rate and only takes a token
+// when all of them have one, so a message denied by one limit does not burn
+// capacity of the others. It returns how many milliseconds to wait.
+var takeScript = redis.NewScript(`
+local now = redis.call('TIME')
+local nowMs = tonumber(now[1]) * 1000 + math.floor(tonumber(now[2]) / 1000)
+local tokens = {}
+local wait = 0
+
+for i, key in ipairs(KEYS) do
+	local capacity = tonumber(ARGV[i * 2 - 1])
+	local period = tonumber(ARGV[i * 2])
+	local state = redis.call('HMGET', key, 'tokens', 'ts')
+	local available = tonumber(state[1]) or capacity
+	local ts = tonumber(state[2]) or nowMs
+	available = math.min(capacity, available + (nowMs - ts) * capacity / period)
+	tokens[i] = available
+	if available < 1 then
+		wait = math.max(wait, math.ceil((1 - available) * period / capacity))
+	end
+end
+
+for i, key in ipairs(KEYS) do
+	local available = tokens[i]
+	if wait == 0 then
+		available = available - 1
+	end
+	redis.call('HSET', key, 'tokens', available, 'ts', nowMs)
+	redis.call('PEXPIRE', key, tonumber(ARGV[i * 2]) * 2)
+end
+
+return wait
+`)
+
+type Rate struct {
+	Limit int
+	Per   time.Duration
+}
+
+// ParseRate parses limits such as "30/s", "100/h" or "600/m".
+func ParseRate(value string) (Rate, error) {
+	limit, unit, ok := strings.Cut(strings.TrimSpace(value), "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q", value)
+	}
+
+	n, err := strconv.Atoi(limit)
+	if err != nil || n <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate %q", value)
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	case "d":
+		per = 24 * time.Hour
+	default:
+		if per, err = time.ParseDuration(unit); err != nil {
+			return Rate{}, fmt.Errorf("invalid rate %q", value)
+		}
+		// The buckets refill per millisecond, so shorter periods would
+		// divide by zero in takeScript.
+		if per < time.Millisecond {
+			return Rate{}, fmt.Errorf("invalid rate %q: period must be at least 1ms", value)
+		}
+	}
+
+	return Rate{Limit: n, Per: per}, nil
+}
+
+type Rules struct {
+	Channels  map[string]Rate
+	Recipient Rate
+}
+
+// ParseRules parses channel limits ("telegram=30/s" entries) and the
+// per-recipient limit ("100/h"), which may be empty.
+func ParseRules(channels []string, recipient string) (Rules, error) {
+	rules := Rules{Channels: make(map[string]Rate)}
+
+	for _, entry := range channels {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		channel, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return Rules{}, fmt.Errorf("invalid channel rate limit %q", entry)
+		}
+		rate, err := ParseRate(value)
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid channel rate limit %q: %w", entry, err)
+		}
+		rules.Channels[channel] = rate
+	}
+
+	if recipient != "" {
+		rate, err := ParseRate(recipient)
+		if err != nil {
+			return Rules{}, fmt.Errorf("invalid recipient rate limit: %w", err)
+		}
+		rules.Recipient = rate
+	}
+
+	return rules, nil
+}
+
+// Limiter keeps token buckets in Redis so that all worker replicas share the
+// same budget. Tenant limits come from the tenant's sends per minute quota.
+type Limiter struct {
+	client  *redis.Client
+	tenants *tenant.Registry
+
+	mu    sync.RWMutex
+	rules Rules
+}
+
+func NewLimiter(addr string, rules Rules, tenants *tenant.Registry) *Limiter {
+	return &Limiter{
+		client:  wbfredis.New(addr, "", 0).Client,
+		rules:   rules,
+		tenants: tenants,
+	}
+}
+
+// SetRules replaces the rules. Buckets already in Redis refill at the new
+// rate from their current level.
+func (l *Limiter) SetRules(rules Rules) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = rules
+}
+
+// Reserve takes a token from every bucket that applies to the notification.
+// A zero duration means the notification may be sent now, otherwise nothing
+// is taken and the caller should retry after the returned delay.
+func (l *Limiter) Reserve(ctx context.Context, notification *models.Notification) (time.Duration, error) {
+	var keys []string
+	var args []interface{}
+
+	add := func(key string, rate Rate) {
+		if rate.Limit <= 0 {
+			return
+		}
+		keys = append(keys, "ratelimit:"+key)
+		args = append(args, rate.Limit, rate.Per.Milliseconds())
+	}
+
+	l.mu.RLock()
+	rules := l.rules
+	l.mu.RUnlock()
+
+	add("channel:"+notification.Channel, rules.Channels[notification.Channel])
+	if notification.Recipient != "" {
+		add("recipient:"+notification.TenantID+":"+notification.Recipient, rules.Recipient)
+	}
+	if quota := l.tenants.Quota(notification.TenantID); quota.SendsPerMinute > 0 {
+		add("tenant:"+notification.TenantID, Rate{Limit: quota.SendsPerMinute, Per: time.Minute})
+	}
+
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	wait, err := takeScript.Run(ctx, l.client, keys, args...).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to reserve rate limit tokens: %w", err)
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
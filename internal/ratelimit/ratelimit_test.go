@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Rate
+		wantErr bool
+	}{
+		{value: "30/s", want: Rate{Limit: 30, Per: time.Second}},
+		{value: " 600/m ", want: Rate{Limit: 600, Per: time.Minute}},
+		{value: "100/h", want: Rate{Limit: 100, Per: time.Hour}},
+		{value: "1000/d", want: Rate{Limit: 1000, Per: 24 * time.Hour}},
+		{value: "5/250ms", want: Rate{Limit: 5, Per: 250 * time.Millisecond}},
+		{value: "5/1ms", want: Rate{Limit: 5, Per: time.Millisecond}},
+		{value: "5/500us", wantErr: true},
+		{value: "5/0s", wantErr: true},
+		{value: "5/-1s", wantErr: true},
+		{value: "0/s", wantErr: true},
+		{value: "-1/s", wantErr: true},
+		{value: "x/s", wantErr: true},
+		{value: "30", wantErr: true},
+		{value: "30/fortnight", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRate(%q) = %+v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRate(%q): %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
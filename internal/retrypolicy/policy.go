@@ -0,0 +1,235 @@
+package retrypolicy
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+
+	"notifier/internal/models"
+)
+
+const DefaultName = "default"
+
+const (
+	KindExponential = "exponential"
+	KindLinear      = "linear"
+	KindFixed       = "fixed"
+
+	JitterNone         = "none"
+	JitterFull         = "full"
+	JitterDecorrelated = "decorrelated"
+)
+
+// Policy decides how long to wait before the next delivery attempt.
+//
+//   - exponential waits Base * Multiplier^(attempt-1)
+//   - linear waits Base * attempt
+//   - fixed always waits Base
+//
+// The delay is capped at MaxDelay and then jittered: full jitter picks
+// uniformly from [0, delay], decorrelated jitter from [Base, 3 * previous
+// delay]. Retries stop once the next attempt would fall more than MaxTotal
+// after the notification's original send time.
+type Policy struct {
+	Name       string
+	Kind       string
+	Base       time.Duration
+	Multiplier float64
+	MaxDelay   time.Duration
+	Jitter     string
+	MaxTotal   time.Duration
+}
+
+// Default reproduces the original behaviour: 2s, 4s, 8s... up to 5 minutes.
+var Default = Policy{
+	Name:       DefaultName,
+	Kind:       KindExponential,
+	Base:       2 * time.Second,
+	Multiplier: 2,
+	MaxDelay:   5 * time.Minute,
+	Jitter:     JitterNone,
+}
+
+func (p Policy) Validate() error {
+	switch p.Kind {
+	case KindExponential:
+		if p.Multiplier < 1 {
+			return fmt.Errorf("retry policy %s: multiplier must be at least 1", p.Name)
+		}
+	case KindLinear, KindFixed:
+	default:
+		return fmt.Errorf("retry policy %s: unknown kind %q", p.Name, p.Kind)
+	}
+
+	switch p.Jitter {
+	case "", JitterNone, JitterFull, JitterDecorrelated:
+	default:
+		return fmt.Errorf("retry policy %s: unknown jitter %q", p.Name, p.Jitter)
+	}
+
+	if p.Base <= 0 {
+		return fmt.Errorf("retry policy %s: base must be positive", p.Name)
+	}
+	if p.MaxDelay < 0 || p.MaxTotal < 0 {
+		return fmt.Errorf("retry policy %s: limits must not be negative", p.Name)
+	}
+	return nil
+}
+
+// Delay returns the wait before the given attempt (1 for the first retry).
+// previous is the delay used before the last attempt, or zero.
+func (p Policy) Delay(attempt int, previous time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	var delay time.Duration
+	switch p.Kind {
+	case KindFixed:
+		delay = p.Base
+	case KindLinear:
+		delay = p.Base * time.Duration(attempt)
+	default:
+		scaled := float64(p.Base) * math.Pow(p.Multiplier, float64(attempt-1))
+		if scaled >= math.MaxInt64 {
+			delay = math.MaxInt64
+		} else {
+			delay = time.Duration(scaled)
+		}
+	}
+	delay = p.cap(delay)
+
+	switch p.Jitter {
+	case JitterFull:
+		delay = time.Duration(rand.Int63n(int64(delay)))
+	case JitterDecorrelated:
+		upper := p.cap(max(previous, p.Base) * 3)
+		delay = p.Base
+		if upper > p.Base {
+			delay += time.Duration(rand.Int63n(int64(upper - p.Base)))
+		}
+	}
+	return delay
+}
+
+// cap also absorbs overflow from large attempts or multipliers.
+func (p Policy) cap(delay time.Duration) time.Duration {
+	if delay <= 0 {
+		delay = math.MaxInt64
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// Exhausted reports whether an attempt at next falls outside MaxTotal,
+// counted from the send time or, for immediate notifications, creation.
+func (p Policy) Exhausted(notification *models.Notification, next time.Time) bool {
+	start := notification.SendAt
+	if start.Before(notification.CreatedAt) {
+		start = notification.CreatedAt
+	}
+	return p.MaxTotal > 0 && next.After(start.Add(p.MaxTotal))
+}
+
+// Registry holds the named policies and which one each channel uses.
+type Registry struct {
+	policies map[string]Policy
+	channels map[string]string
+}
+
+// Spec is a policy as written in the configuration, with durations such as
+// "5s" and defaults for the kind (exponential) and multiplier (2).
+type Spec struct {
+	Kind       string  `json:"kind" mapstructure:"kind"`
+	Base       string  `json:"base" mapstructure:"base"`
+	Multiplier float64 `json:"multiplier" mapstructure:"multiplier"`
+	MaxDelay   string  `json:"max_delay" mapstructure:"max_delay"`
+	Jitter     string  `json:"jitter" mapstructure:"jitter"`
+	MaxTotal   string  `json:"max_total" mapstructure:"max_total"`
+}
+
+// NewRegistry builds the named policies from specs and assigns them to
+// channels by "channel:policy" entries such as "email:slow". A policy named
+// "default" replaces Default. Policy names are case-insensitive.
+func NewRegistry(specs map[string]Spec, channelPolicies []string) (*Registry, error) {
+	r := &Registry{
+		policies: map[string]Policy{DefaultName: Default},
+		channels: make(map[string]string),
+	}
+
+	for name, spec := range specs {
+		name = strings.ToLower(name)
+		policy, err := spec.policy(name)
+		if err != nil {
+			return nil, err
+		}
+		r.policies[name] = policy
+	}
+
+	for _, pair := range channelPolicies {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		channel, name, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid channel retry policy %q", pair)
+		}
+		if !r.Has(name) {
+			return nil, fmt.Errorf("unknown retry policy %q for channel %s", name, channel)
+		}
+		r.channels[channel] = strings.ToLower(name)
+	}
+
+	return r, nil
+}
+
+func (s Spec) policy(name string) (Policy, error) {
+	policy := Policy{
+		Name:       name,
+		Kind:       s.Kind,
+		Multiplier: s.Multiplier,
+		Jitter:     s.Jitter,
+	}
+	if policy.Kind == "" {
+		policy.Kind = KindExponential
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = 2
+	}
+
+	var err error
+	for _, field := range []struct {
+		value string
+		dest  *time.Duration
+	}{{s.Base, &policy.Base}, {s.MaxDelay, &policy.MaxDelay}, {s.MaxTotal, &policy.MaxTotal}} {
+		if field.value == "" {
+			continue
+		}
+		if *field.dest, err = time.ParseDuration(field.value); err != nil {
+			return Policy{}, fmt.Errorf("retry policy %s: %w", name, err)
+		}
+	}
+
+	return policy, policy.Validate()
+}
+
+func (r *Registry) Has(name string) bool {
+	_, ok := r.policies[strings.ToLower(name)]
+	return ok
+}
+
+// For picks the notification's own policy, then its channel's, then the
+// default.
+func (r *Registry) For(notification *models.Notification) Policy {
+	if policy, ok := r.policies[strings.ToLower(notification.RetryPolicy)]; ok {
+		return policy
+	}
+	if policy, ok := r.policies[r.channels[notification.Channel]]; ok {
+		return policy
+	}
+	return r.policies[DefaultName]
+}
@@ -2,22 +2,62 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
+	"notifier/internal/logging"
 	"notifier/internal/models"
+	"notifier/internal/tenant"
 )
 
 type MemoryStorage struct {
 	mu            sync.RWMutex
 	notifications map[string]*models.Notification
+	counters      map[string]int64
+	statuses      map[string]map[models.NotificationStatus]int64
+	outbox        map[string]*outboxItem
+	callbacks     map[string]*callbackItem
+	watchers      []chan DueChange
+	changes       []chan Change
+	events        map[string][]models.Event
+}
+
+type outboxItem struct {
+	entry        *models.OutboxEntry
+	visibleAfter time.Time
+}
+
+type callbackItem struct {
+	entry        *models.CallbackEntry
+	visibleAfter time.Time
 }
 
 func (s *MemoryStorage) Create(ctx context.Context, notification *models.Notification) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	notification.TenantID = tenant.FromContext(ctx)
 	s.notifications[notification.ID] = notification
+	s.countStatus(notification.TenantID, "", notification.Status)
+	s.announce(notification)
+	created := *notification
+	s.publishChange(Change{Type: ChangeCreated, TenantID: notification.TenantID, Notification: &created})
+
+	if s.outbox == nil {
+		s.outbox = make(map[string]*outboxItem)
+	}
+	id := outboxEntryID(notification.TenantID, notification.ID)
+	s.outbox[id] = &outboxItem{
+		entry: &models.OutboxEntry{
+			ID:             id,
+			TenantID:       notification.TenantID,
+			NotificationID: notification.ID,
+			CreatedAt:      time.Now(),
+			Trace:          traceCarrier(ctx),
+			RequestID:      logging.RequestID(ctx),
+		},
+	}
 	return nil
 }
 
@@ -26,7 +66,7 @@ func (s *MemoryStorage) GetByID(ctx context.Context, id string) (*models.Notific
 	defer s.mu.RUnlock()
 
 	notification, exists := s.notifications[id]
-	if !exists {
+	if !exists || notification.TenantID != tenant.FromContext(ctx) {
 		return nil, nil
 	}
 	return notification, nil
@@ -37,30 +77,399 @@ func (s *MemoryStorage) Update(ctx context.Context, id string, updateFn func(*mo
 	defer s.mu.Unlock()
 
 	notification, exists := s.notifications[id]
-	if !exists {
+	if !exists || notification.TenantID != tenant.FromContext(ctx) {
 		return nil
 	}
 
+	oldStatus := notification.Status
 	updateFn(notification)
 	notification.UpdatedAt = time.Now()
+	s.countStatus(notification.TenantID, oldStatus, notification.Status)
+	s.enqueueCallback(notification, oldStatus)
+	s.publishUpdate(notification, oldStatus)
 	return nil
 }
 
+func (s *MemoryStorage) UpdateIf(ctx context.Context, id string, updateFn func(*models.Notification) bool) (*models.Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notification, exists := s.notifications[id]
+	if !exists || notification.TenantID != tenant.FromContext(ctx) {
+		return nil, nil
+	}
+
+	updated := *notification
+	if !updateFn(&updated) {
+		return nil, nil
+	}
+	updated.UpdatedAt = time.Now()
+	if updated.Status != notification.Status || !updated.DueAt().Equal(notification.DueAt()) {
+		s.announce(&updated)
+	}
+	s.countStatus(updated.TenantID, notification.Status, updated.Status)
+	s.enqueueCallback(&updated, notification.Status)
+	s.publishUpdate(&updated, notification.Status)
+	*notification = updated
+	return &updated, nil
+}
+
+// countStatus moves a notification between the tenant's status counters; an
+// empty status stands for no notification. It must be called with the lock
+// held.
+func (s *MemoryStorage) countStatus(tenantID string, from, to models.NotificationStatus) {
+	if from == to {
+		return
+	}
+	if s.statuses == nil {
+		s.statuses = make(map[string]map[models.NotificationStatus]int64)
+	}
+	counts, ok := s.statuses[tenantID]
+	if !ok {
+		counts = make(map[models.NotificationStatus]int64)
+		s.statuses[tenantID] = counts
+	}
+	if from != "" {
+		counts[from]--
+	}
+	if to != "" {
+		counts[to]++
+	}
+}
+
+// publishUpdate must be called with the lock held.
+func (s *MemoryStorage) publishUpdate(notification *models.Notification, oldStatus models.NotificationStatus) {
+	snapshot := *notification
+	change := Change{Type: ChangeUpdated, TenantID: notification.TenantID, Notification: &snapshot}
+	if notification.Status != oldStatus {
+		change.Type = ChangeStatus
+		change.PreviousStatus = oldStatus
+	}
+	s.publishChange(change)
+}
+
+// publishChange must be called with the lock held. Like announce, it drops
+// changes for slow watchers.
+func (s *MemoryStorage) publishChange(change Change) {
+	for _, watcher := range s.changes {
+		select {
+		case watcher <- change:
+		default:
+		}
+	}
+}
+
+func (s *MemoryStorage) WatchChanges(ctx context.Context) (<-chan Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := make(chan Change, 256)
+	s.changes = append(s.changes, changes)
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, watcher := range s.changes {
+			if watcher == changes {
+				s.changes = append(s.changes[:i], s.changes[i+1:]...)
+				break
+			}
+		}
+		close(changes)
+	}()
+
+	return changes, nil
+}
+
+// enqueueCallback must be called with the lock held.
+func (s *MemoryStorage) enqueueCallback(notification *models.Notification, oldStatus models.NotificationStatus) {
+	if oldStatus == notification.Status || !notification.Status.Final() {
+		return
+	}
+
+	if s.callbacks == nil {
+		s.callbacks = make(map[string]*callbackItem)
+	}
+	id := callbackEntryID(notification.TenantID, notification.ID, notification.Status)
+	s.callbacks[id] = &callbackItem{
+		entry: &models.CallbackEntry{
+			ID:             id,
+			TenantID:       notification.TenantID,
+			NotificationID: notification.ID,
+			Status:         notification.Status,
+			OccurredAt:     notification.UpdatedAt,
+		},
+	}
+}
+
+// announce must be called with the lock held. Slow watchers miss changes
+// rather than block writers.
+func (s *MemoryStorage) announce(notification *models.Notification) {
+	change := DueChange{
+		TenantID: notification.TenantID,
+		ID:       notification.ID,
+		Status:   notification.Status,
+		DueAt:    notification.DueAt(),
+	}
+	for _, watcher := range s.watchers {
+		select {
+		case watcher <- change:
+		default:
+		}
+	}
+}
+
+func (s *MemoryStorage) WatchDue(ctx context.Context) (<-chan DueChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := make(chan DueChange, 256)
+	s.watchers = append(s.watchers, changes)
+
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, watcher := range s.watchers {
+			if watcher == changes {
+				s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+				break
+			}
+		}
+		close(changes)
+	}()
+
+	return changes, nil
+}
+
 func (s *MemoryStorage) Delete(ctx context.Context, id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.notifications, id)
+	if notification, exists := s.notifications[id]; exists && notification.TenantID == tenant.FromContext(ctx) {
+		delete(s.notifications, id)
+		delete(s.events, id)
+		s.countStatus(notification.TenantID, notification.Status, "")
+	}
 	return nil
 }
 
+func (s *MemoryStorage) AppendEvent(ctx context.Context, id string, event *models.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if notification, exists := s.notifications[id]; !exists || notification.TenantID != tenant.FromContext(ctx) {
+		return fmt.Errorf("notification %s not found", id)
+	}
+	if s.events == nil {
+		s.events = make(map[string][]models.Event)
+	}
+	s.events[id] = append(s.events[id], *event)
+	return nil
+}
+
+func (s *MemoryStorage) GetEvents(ctx context.Context, id string) ([]models.Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if notification, exists := s.notifications[id]; !exists || notification.TenantID != tenant.FromContext(ctx) {
+		return nil, nil
+	}
+	return append([]models.Event(nil), s.events[id]...), nil
+}
+
 func (s *MemoryStorage) GetAll(ctx context.Context) ([]*models.Notification, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	tenantID := tenant.FromContext(ctx)
 	notifications := make([]*models.Notification, 0, len(s.notifications))
 	for _, n := range s.notifications {
-		notifications = append(notifications, n)
+		if n.TenantID == tenantID {
+			notifications = append(notifications, n)
+		}
 	}
 	return notifications, nil
 }
+
+func (s *MemoryStorage) GetDue(ctx context.Context, until time.Time) ([]*models.Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenantID := tenant.FromContext(ctx)
+	var notifications []*models.Notification
+	for _, n := range s.notifications {
+		if n.TenantID == tenantID && !n.DueAt().After(until) &&
+			(n.Status == models.StatusPending || n.Status == models.StatusRetrying) {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications, nil
+}
+
+func (s *MemoryStorage) GetExpired(ctx context.Context, now time.Time) ([]*models.Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenantID := tenant.FromContext(ctx)
+	var notifications []*models.Notification
+	for _, n := range s.notifications {
+		if n.TenantID == tenantID && n.ExpiresAt != nil && !n.ExpiresAt.After(now) &&
+			(n.Status == models.StatusPending || n.Status == models.StatusRetrying) {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications, nil
+}
+
+func (s *MemoryStorage) GetLeaseExpired(ctx context.Context, now time.Time) ([]*models.Notification, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenantID := tenant.FromContext(ctx)
+	var notifications []*models.Notification
+	for _, n := range s.notifications {
+		if n.TenantID == tenantID && n.Status == models.StatusSending &&
+			n.LeaseUntil != nil && !n.LeaseUntil.After(now) {
+			notifications = append(notifications, n)
+		}
+	}
+	return notifications, nil
+}
+
+func (s *MemoryStorage) Tenants(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var tenants []string
+	for _, n := range s.notifications {
+		if !seen[n.TenantID] {
+			seen[n.TenantID] = true
+			tenants = append(tenants, n.TenantID)
+		}
+	}
+	return tenants, nil
+}
+
+func (s *MemoryStorage) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStorage) CountPending(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenantID := tenant.FromContext(ctx)
+	var count int64
+	for _, n := range s.notifications {
+		if n.TenantID == tenantID && (n.Status == models.StatusPending || n.Status == models.StatusRetrying) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryStorage) StatusCounts(ctx context.Context) (map[models.NotificationStatus]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[models.NotificationStatus]int64)
+	for status, count := range s.statuses[tenant.FromContext(ctx)] {
+		counts[status] = count
+	}
+	return counts, nil
+}
+
+func (s *MemoryStorage) IncrementCounter(ctx context.Context, name string, window time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.counters == nil {
+		s.counters = make(map[string]int64)
+	}
+	bucket := time.Now().UnixNano() / int64(window)
+	key := fmt.Sprintf("%s:%s:%d", tenant.FromContext(ctx), name, bucket)
+	s.counters[key]++
+	return s.counters[key], nil
+}
+
+func (s *MemoryStorage) DecrementCounter(ctx context.Context, name string, window time.Duration, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := at.UnixNano() / int64(window)
+	key := fmt.Sprintf("%s:%s:%d", tenant.FromContext(ctx), name, bucket)
+	if s.counters[key] > 0 {
+		s.counters[key]--
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var entries []*models.OutboxEntry
+	for _, item := range s.outbox {
+		if len(entries) >= limit {
+			break
+		}
+		if item.visibleAfter.After(now) {
+			continue
+		}
+		item.visibleAfter = now.Add(lease)
+		entries = append(entries, item.entry)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStorage) CompleteOutbox(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.outbox, id)
+	return nil
+}
+
+func (s *MemoryStorage) ClaimCallbacks(ctx context.Context, limit int, lease time.Duration) ([]*models.CallbackEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var entries []*models.CallbackEntry
+	for _, item := range s.callbacks {
+		if len(entries) >= limit {
+			break
+		}
+		if item.visibleAfter.After(now) {
+			continue
+		}
+		item.visibleAfter = now.Add(lease)
+		entry := *item.entry
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+func (s *MemoryStorage) RetryCallback(ctx context.Context, entry *models.CallbackEntry, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.callbacks == nil {
+		s.callbacks = make(map[string]*callbackItem)
+	}
+	stored := *entry
+	s.callbacks[entry.ID] = &callbackItem{entry: &stored, visibleAfter: at}
+	return nil
+}
+
+func (s *MemoryStorage) CompleteCallback(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.callbacks, id)
+	return nil
+}
@@ -4,15 +4,61 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	wbfredis "github.com/wb-go/wbf/redis"
 	wbfretry "github.com/wb-go/wbf/retry"
+	"notifier/internal/logging"
 	"notifier/internal/models"
+	"notifier/internal/tenant"
 )
 
+const (
+	tenantsKey       = "notifications:tenants"
+	outboxEntriesKey = "outbox:entries"
+	outboxPendingKey = "outbox:pending"
+	dueChannel       = "notifications:due"
+	changesChannel   = "notifications:changes"
+
+	callbackEntriesKey = "callbacks:entries"
+	callbackPendingKey = "callbacks:pending"
+
+	// Notifications stored before tenants existed, migrated to the default
+	// tenant by migrateLegacy.
+	legacyAllKey     = "notifications:all"
+	legacyPendingKey = "notifications:pending"
+
+	// statusCountedField marks a tenant's status hash as complete. Tenants
+	// whose notifications predate the counters get it from rebuildStatusCounts.
+	statusCountedField = "_counted"
+)
+
+// claimOutboxScript hands out entries that are due and pushes their score
+// forward by the lease, so a relay that dies mid-publish only delays them.
+// Callback entries are claimed the same way.
+var claimOutboxScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[3]))
+for _, id in ipairs(ids) do
+	redis.call('ZADD', KEYS[1], ARGV[2], id)
+end
+if #ids == 0 then
+	return {}
+end
+return redis.call('HMGET', KEYS[2], unpack(ids))
+`)
+
+// decrementScript decrements a counter only while its key still exists, so
+// it never outlives its window.
+var decrementScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return redis.call('DECR', KEYS[1])
+end
+return 0
+`)
+
 type RedisStorage struct {
 	client *redis.Client
 }
@@ -39,19 +85,124 @@ func NewRedisStorage(addr string) (*RedisStorage, error) {
 		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
-	log.Println("Successfully connected to Redis using wbf/redis client")
+	slog.InfoContext(ctx, "Connected to Redis", "addr", addr)
 
-	return &RedisStorage{
+	s := &RedisStorage{
 		client: wbfClient.Client,
-	}, nil
+	}
+	if err := s.migrateLegacy(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrateLegacy moves notifications stored before tenants existed, under
+// notification:<id> and the unprefixed indexes, to the default tenant. Each
+// one is moved in its own transaction and dropped from the legacy set, so
+// the migration resumes where it stopped and finds nothing once done.
+func (s *RedisStorage) migrateLegacy(ctx context.Context) error {
+	ids, err := s.client.SMembers(ctx, legacyAllKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list legacy notifications: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ctx = tenant.WithTenant(ctx, tenant.Default)
+	for _, id := range ids {
+		legacyKey := "notification:" + id
+		txFn := func(tx *redis.Tx) error {
+			migrated, err := tx.Exists(ctx, s.key(ctx, "notification:"+id)).Result()
+			if err != nil {
+				return err
+			}
+			data, err := tx.Get(ctx, legacyKey).Bytes()
+			// Gone, or moved already: only the legacy entries are left.
+			if err == redis.Nil || err == nil && migrated > 0 {
+				_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					pipe.Del(ctx, legacyKey)
+					pipe.SRem(ctx, legacyAllKey, id)
+					pipe.ZRem(ctx, legacyPendingKey, id)
+					return nil
+				})
+				return err
+			}
+			if err != nil {
+				return err
+			}
+
+			var notification models.Notification
+			if err := json.Unmarshal(data, &notification); err != nil {
+				return fmt.Errorf("failed to unmarshal notification: %w", err)
+			}
+			notification.TenantID = tenant.Default
+			// Legacy retries were due at NextRetry.
+			if notification.Status == models.StatusRetrying && notification.NextRetry != nil && notification.EffectiveSendAt == nil {
+				notification.EffectiveSendAt = notification.NextRetry
+			}
+			if data, err = json.Marshal(&notification); err != nil {
+				return fmt.Errorf("failed to marshal notification: %w", err)
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, s.key(ctx, "notification:"+id), data, 0)
+				pipe.SAdd(ctx, s.key(ctx, "notifications:all"), id)
+				pipe.SAdd(ctx, tenantsKey, tenant.Default)
+				if notification.Status == models.StatusPending || notification.Status == models.StatusRetrying {
+					pipe.ZAdd(ctx, s.key(ctx, "notifications:pending"), &redis.Z{
+						Score:  float64(notification.DueAt().Unix()),
+						Member: id,
+					})
+				}
+				pipe.Del(ctx, legacyKey)
+				pipe.SRem(ctx, legacyAllKey, id)
+				pipe.ZRem(ctx, legacyPendingKey, id)
+				return nil
+			})
+			return err
+		}
+
+		if err := s.client.Watch(ctx, txFn, legacyKey, s.key(ctx, "notification:"+id)); err != nil && err != redis.TxFailedErr {
+			return fmt.Errorf("failed to migrate legacy notification %s: %w", id, err)
+		}
+	}
+
+	// The counters are rebuilt on the next read to include the migrated
+	// notifications.
+	if err := s.client.HDel(ctx, s.key(ctx, "notifications:status"), statusCountedField).Err(); err != nil {
+		return fmt.Errorf("failed to reset status counts: %w", err)
+	}
+	slog.InfoContext(ctx, "Migrated legacy notifications", logging.KeyTenant, tenant.Default, "count", len(ids))
+	return nil
 }
 
+func (s *RedisStorage) key(ctx context.Context, suffix string) string {
+	return "tenant:" + tenant.FromContext(ctx) + ":" + suffix
+}
+
+// Create stores the notification, its indexes and an outbox entry in a
+// single MULTI/EXEC transaction, so a stored notification is always
+// eventually handed to the queue by the outbox relay.
 func (s *RedisStorage) Create(ctx context.Context, notification *models.Notification) error {
 	data, err := json.Marshal(notification)
 	if err != nil {
 		return fmt.Errorf("failed to marshal notification: %w", err)
 	}
 
+	entry := &models.OutboxEntry{
+		ID:             outboxEntryID(tenant.FromContext(ctx), notification.ID),
+		TenantID:       tenant.FromContext(ctx),
+		NotificationID: notification.ID,
+		CreatedAt:      time.Now(),
+		Trace:          traceCarrier(ctx),
+		RequestID:      logging.RequestID(ctx),
+	}
+	entryData, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox entry: %w", err)
+	}
+
 	retryStrategy := wbfretry.Strategy{
 		Attempts: 3,
 		Delay:    100 * time.Millisecond,
@@ -59,36 +210,40 @@ func (s *RedisStorage) Create(ctx context.Context, notification *models.Notifica
 	}
 
 	err = wbfretry.DoContext(ctx, retryStrategy, func() error {
-		return s.client.Set(ctx, "notification:"+notification.ID, data, 0).Err()
-	})
-	if err != nil {
-		return fmt.Errorf("failed to store notification: %w", err)
-	}
-
-	err = wbfretry.DoContext(ctx, retryStrategy, func() error {
-		return s.client.SAdd(ctx, "notifications:all", notification.ID).Err()
-	})
-	if err != nil {
-		return fmt.Errorf("failed to add to notifications set: %w", err)
-	}
+		_, txErr := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.key(ctx, "notification:"+notification.ID), data, 0)
+			pipe.SAdd(ctx, s.key(ctx, "notifications:all"), notification.ID)
+			pipe.SAdd(ctx, tenantsKey, tenant.FromContext(ctx))
+			pipe.HIncrBy(ctx, s.key(ctx, "notifications:status"), string(notification.Status), 1)
+
+			if notification.Status == models.StatusPending || notification.Status == models.StatusRetrying {
+				pipe.ZAdd(ctx, s.key(ctx, "notifications:pending"), &redis.Z{
+					Score:  float64(notification.DueAt().Unix()),
+					Member: notification.ID,
+				})
+
+				if notification.ExpiresAt != nil {
+					pipe.ZAdd(ctx, s.key(ctx, "notifications:expiring"), &redis.Z{
+						Score:  float64(notification.ExpiresAt.Unix()),
+						Member: notification.ID,
+					})
+				}
+			}
 
-	if notification.Status == models.StatusPending || notification.Status == models.StatusRetrying {
-		var sendTime time.Time
-		if notification.Status == models.StatusRetrying && notification.NextRetry != nil {
-			sendTime = *notification.NextRetry
-		} else {
-			sendTime = notification.SendAt
-		}
+			s.announce(ctx, pipe, notification)
+			s.publishChange(ctx, pipe, Change{Type: ChangeCreated, Notification: notification})
 
-		err = wbfretry.DoContext(ctx, retryStrategy, func() error {
-			return s.client.ZAdd(ctx, "notifications:pending", &redis.Z{
-				Score:  float64(sendTime.Unix()),
-				Member: notification.ID,
-			}).Err()
+			pipe.HSet(ctx, outboxEntriesKey, entry.ID, entryData)
+			pipe.ZAdd(ctx, outboxPendingKey, &redis.Z{
+				Score:  float64(entry.CreatedAt.UnixMilli()),
+				Member: entry.ID,
+			})
+			return nil
 		})
-		if err != nil {
-			return fmt.Errorf("failed to add to pending notifications: %w", err)
-		}
+		return txErr
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store notification: %w", err)
 	}
 
 	return nil
@@ -104,7 +259,7 @@ func (s *RedisStorage) GetByID(ctx context.Context, id string) (*models.Notifica
 	var data []byte
 
 	retryErr := wbfretry.DoContext(ctx, retryStrategy, func() error {
-		result, getErr := s.client.Get(ctx, "notification:"+id).Bytes()
+		result, getErr := s.client.Get(ctx, s.key(ctx, "notification:"+id)).Bytes()
 		if getErr != nil && getErr != redis.Nil {
 			return getErr
 		}
@@ -129,21 +284,70 @@ func (s *RedisStorage) GetByID(ctx context.Context, id string) (*models.Notifica
 }
 
 func (s *RedisStorage) Update(ctx context.Context, id string, updateFn func(*models.Notification)) error {
-	notification, err := s.GetByID(ctx, id)
+	notification, err := s.UpdateIf(ctx, id, func(n *models.Notification) bool {
+		updateFn(n)
+		return true
+	})
 	if err != nil {
 		return err
 	}
 	if notification == nil {
 		return fmt.Errorf("notification not found")
 	}
+	return nil
+}
 
-	oldStatus := notification.Status
-	updateFn(notification)
-	notification.UpdatedAt = time.Now()
+// UpdateIf reads, changes and writes the notification inside WATCH/MULTI,
+// so concurrent updates never overwrite each other. A conflicting write makes
+// the transaction fail and the update is retried on fresh data.
+func (s *RedisStorage) UpdateIf(ctx context.Context, id string, updateFn func(*models.Notification) bool) (*models.Notification, error) {
+	key := s.key(ctx, "notification:"+id)
 
-	data, err := json.Marshal(notification)
-	if err != nil {
-		return fmt.Errorf("failed to marshal notification: %w", err)
+	var updated *models.Notification
+	txFn := func(tx *redis.Tx) error {
+		updated = nil
+
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var notification models.Notification
+		if err := json.Unmarshal(data, &notification); err != nil {
+			return fmt.Errorf("failed to unmarshal notification: %w", err)
+		}
+
+		oldStatus := notification.Status
+		oldDueAt := notification.DueAt()
+		if !updateFn(&notification) {
+			return nil
+		}
+		notification.UpdatedAt = time.Now()
+
+		data, err = json.Marshal(&notification)
+		if err != nil {
+			return fmt.Errorf("failed to marshal notification: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, 0)
+			s.reindex(ctx, pipe, &notification, oldStatus, oldDueAt)
+
+			change := Change{Type: ChangeUpdated, Notification: &notification}
+			if notification.Status != oldStatus {
+				change.Type = ChangeStatus
+				change.PreviousStatus = oldStatus
+			}
+			s.publishChange(ctx, pipe, change)
+			return nil
+		})
+		if err == nil {
+			updated = &notification
+		}
+		return err
 	}
 
 	retryStrategy := wbfretry.Strategy{
@@ -152,35 +356,190 @@ func (s *RedisStorage) Update(ctx context.Context, id string, updateFn func(*mod
 		Backoff:  2,
 	}
 
-	err = wbfretry.DoContext(ctx, retryStrategy, func() error {
-		return s.client.Set(ctx, "notification:"+id, data, 0).Err()
+	err := wbfretry.DoContext(ctx, retryStrategy, func() error {
+		return s.client.Watch(ctx, txFn, key)
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update notification: %w", err)
+		return nil, fmt.Errorf("failed to update notification: %w", err)
 	}
 
+	return updated, nil
+}
+
+func (s *RedisStorage) reindex(ctx context.Context, pipe redis.Pipeliner, notification *models.Notification,
+	oldStatus models.NotificationStatus, oldDueAt time.Time) {
+	id := notification.ID
+
 	if oldStatus != notification.Status {
-		s.client.ZRem(ctx, "notifications:pending", id)
+		pipe.HIncrBy(ctx, s.key(ctx, "notifications:status"), string(oldStatus), -1)
+		pipe.HIncrBy(ctx, s.key(ctx, "notifications:status"), string(notification.Status), 1)
+	}
 
-		if notification.Status == models.StatusPending || notification.Status == models.StatusRetrying {
-			var sendTime time.Time
-			if notification.Status == models.StatusRetrying && notification.NextRetry != nil {
-				sendTime = *notification.NextRetry
-			} else {
-				sendTime = notification.SendAt
-			}
+	if oldStatus != notification.Status || !oldDueAt.Equal(notification.DueAt()) {
+		s.announce(ctx, pipe, notification)
+		pipe.ZRem(ctx, s.key(ctx, "notifications:pending"), id)
 
-			s.client.ZAdd(ctx, "notifications:pending", &redis.Z{
-				Score:  float64(sendTime.Unix()),
+		if notification.Status == models.StatusPending || notification.Status == models.StatusRetrying {
+			pipe.ZAdd(ctx, s.key(ctx, "notifications:pending"), &redis.Z{
+				Score:  float64(notification.DueAt().Unix()),
 				Member: id,
 			})
+
+			if notification.ExpiresAt != nil {
+				pipe.ZAdd(ctx, s.key(ctx, "notifications:expiring"), &redis.Z{
+					Score:  float64(notification.ExpiresAt.Unix()),
+					Member: id,
+				})
+			}
+		} else {
+			pipe.ZRem(ctx, s.key(ctx, "notifications:expiring"), id)
 		}
 	}
 
-	return nil
+	if notification.Status == models.StatusSending && notification.LeaseUntil != nil {
+		pipe.ZAdd(ctx, s.key(ctx, "notifications:leases"), &redis.Z{
+			Score:  float64(notification.LeaseUntil.Unix()),
+			Member: id,
+		})
+	} else if oldStatus == models.StatusSending {
+		pipe.ZRem(ctx, s.key(ctx, "notifications:leases"), id)
+	}
+
+	if oldStatus != notification.Status && notification.Status.Final() {
+		s.enqueueCallback(ctx, pipe, notification)
+	}
+}
+
+// enqueueCallback records the final status change inside the caller's
+// transaction, so the change is reported even if the process dies right
+// after storing it.
+func (s *RedisStorage) enqueueCallback(ctx context.Context, pipe redis.Pipeliner, notification *models.Notification) {
+	entry := &models.CallbackEntry{
+		ID:             callbackEntryID(tenant.FromContext(ctx), notification.ID, notification.Status),
+		TenantID:       tenant.FromContext(ctx),
+		NotificationID: notification.ID,
+		Status:         notification.Status,
+		OccurredAt:     notification.UpdatedAt,
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal callback entry", logging.KeyNotificationID, notification.ID, logging.KeyError, err)
+		return
+	}
+
+	pipe.HSet(ctx, callbackEntriesKey, entry.ID, data)
+	pipe.ZAdd(ctx, callbackPendingKey, &redis.Z{
+		Score:  float64(entry.OccurredAt.UnixMilli()),
+		Member: entry.ID,
+	})
+}
+
+// announce publishes the notification's due state inside the caller's
+// transaction, so subscribers never see a change that was not stored.
+func (s *RedisStorage) announce(ctx context.Context, pipe redis.Pipeliner, notification *models.Notification) {
+	data, err := json.Marshal(DueChange{
+		TenantID: tenant.FromContext(ctx),
+		ID:       notification.ID,
+		Status:   notification.Status,
+		DueAt:    notification.DueAt(),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal due change", logging.KeyNotificationID, notification.ID, logging.KeyError, err)
+		return
+	}
+	pipe.Publish(ctx, dueChannel, data)
+}
+
+// publishChange announces the write inside the caller's transaction, like
+// announce.
+func (s *RedisStorage) publishChange(ctx context.Context, pipe redis.Pipeliner, change Change) {
+	change.TenantID = tenant.FromContext(ctx)
+	data, err := json.Marshal(change)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to marshal change", logging.KeyNotificationID, change.Notification.ID, logging.KeyError, err)
+		return
+	}
+	pipe.Publish(ctx, changesChannel, data)
+}
+
+// WatchDue streams due changes from all tenants until ctx is done. Changes
+// published while no subscription is open are not replayed; callers reload
+// from GetDue instead.
+func (s *RedisStorage) WatchDue(ctx context.Context) (<-chan DueChange, error) {
+	return watch[DueChange](ctx, s.client, dueChannel)
+}
+
+func (s *RedisStorage) WatchChanges(ctx context.Context) (<-chan Change, error) {
+	return watch[Change](ctx, s.client, changesChannel)
+}
+
+// watch subscribes to channel and decodes every message into T.
+func watch[T any](ctx context.Context, client *redis.Client, channel string) (<-chan T, error) {
+	pubsub := client.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, fmt.Errorf("failed to subscribe to %s: %w", channel, err)
+	}
+
+	values := make(chan T, 256)
+	go func() {
+		defer close(values)
+		defer pubsub.Close()
+
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var value T
+				if err := json.Unmarshal([]byte(msg.Payload), &value); err != nil {
+					slog.ErrorContext(ctx, "Error unmarshalling message", "channel", channel, logging.KeyError, err)
+					continue
+				}
+				select {
+				case values <- value:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return values, nil
 }
 
+// Delete removes the notification and takes it off its status counter in
+// one transaction, watching the notification so the counter cannot be
+// decremented for a status it has just left.
 func (s *RedisStorage) Delete(ctx context.Context, id string) error {
+	key := s.key(ctx, "notification:"+id)
+
+	txFn := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var notification models.Notification
+		if err := json.Unmarshal(data, &notification); err != nil {
+			return fmt.Errorf("failed to unmarshal notification: %w", err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.HIncrBy(ctx, s.key(ctx, "notifications:status"), string(notification.Status), -1)
+			return nil
+		})
+		return err
+	}
+
 	retryStrategy := wbfretry.Strategy{
 		Attempts: 3,
 		Delay:    100 * time.Millisecond,
@@ -188,20 +547,64 @@ func (s *RedisStorage) Delete(ctx context.Context, id string) error {
 	}
 
 	err := wbfretry.DoContext(ctx, retryStrategy, func() error {
-		return s.client.Del(ctx, "notification:"+id).Err()
+		return s.client.Watch(ctx, txFn, key)
 	})
 	if err != nil {
 		return fmt.Errorf("failed to delete notification: %w", err)
 	}
 
-	s.client.SRem(ctx, "notifications:all", id)
-	s.client.ZRem(ctx, "notifications:pending", id)
+	s.client.SRem(ctx, s.key(ctx, "notifications:all"), id)
+	s.client.ZRem(ctx, s.key(ctx, "notifications:pending"), id)
+	s.client.ZRem(ctx, s.key(ctx, "notifications:expiring"), id)
+	s.client.ZRem(ctx, s.key(ctx, "notifications:leases"), id)
+	s.client.Del(ctx, s.key(ctx, "events:"+id))
 
 	return nil
 }
 
+// AppendEvent pushes the event onto the notification's event list. Entries
+// are never rewritten, only removed together with the notification.
+func (s *RedisStorage) AppendEvent(ctx context.Context, id string, event *models.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	retryStrategy := wbfretry.Strategy{
+		Attempts: 3,
+		Delay:    100 * time.Millisecond,
+		Backoff:  2,
+	}
+
+	err = wbfretry.DoContext(ctx, retryStrategy, func() error {
+		return s.client.RPush(ctx, s.key(ctx, "events:"+id), data).Err()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to append event: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStorage) GetEvents(ctx context.Context, id string) ([]models.Event, error) {
+	values, err := s.client.LRange(ctx, s.key(ctx, "events:"+id), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get events: %w", err)
+	}
+
+	events := make([]models.Event, 0, len(values))
+	for _, value := range values {
+		var event models.Event
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			slog.ErrorContext(ctx, "Failed to unmarshal event", logging.KeyNotificationID, id, logging.KeyError, err)
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
 func (s *RedisStorage) GetAll(ctx context.Context) ([]*models.Notification, error) {
-	ids, err := s.client.SMembers(ctx, "notifications:all").Result()
+	ids, err := s.client.SMembers(ctx, s.key(ctx, "notifications:all")).Result()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get notification IDs: %w", err)
 	}
@@ -210,7 +613,7 @@ func (s *RedisStorage) GetAll(ctx context.Context) ([]*models.Notification, erro
 	for _, id := range ids {
 		notification, err := s.GetByID(ctx, id)
 		if err != nil {
-			log.Printf("Error getting notification %s: %v", id, err)
+			slog.ErrorContext(ctx, "Error getting notification", logging.KeyNotificationID, id, logging.KeyError, err)
 			continue
 		}
 		if notification != nil {
@@ -224,7 +627,7 @@ func (s *RedisStorage) GetAll(ctx context.Context) ([]*models.Notification, erro
 func (s *RedisStorage) GetPendingNotifications(ctx context.Context) ([]*models.Notification, error) {
 	now := time.Now().Unix()
 
-	ids, err := s.client.ZRangeByScore(ctx, "notifications:pending", &redis.ZRangeBy{
+	ids, err := s.client.ZRangeByScore(ctx, s.key(ctx, "notifications:pending"), &redis.ZRangeBy{
 		Min: "0",
 		Max: fmt.Sprintf("%d", now),
 	}).Result()
@@ -236,7 +639,31 @@ func (s *RedisStorage) GetPendingNotifications(ctx context.Context) ([]*models.N
 	for _, id := range ids {
 		notification, err := s.GetByID(ctx, id)
 		if err != nil {
-			log.Printf("Error getting notification %s: %v", id, err)
+			slog.ErrorContext(ctx, "Error getting notification", logging.KeyNotificationID, id, logging.KeyError, err)
+			continue
+		}
+		if notification != nil {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	return notifications, nil
+}
+
+func (s *RedisStorage) GetDue(ctx context.Context, until time.Time) ([]*models.Notification, error) {
+	ids, err := s.client.ZRangeByScore(ctx, s.key(ctx, "notifications:pending"), &redis.ZRangeBy{
+		Min: "0",
+		Max: fmt.Sprintf("%d", until.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due notifications: %w", err)
+	}
+
+	var notifications []*models.Notification
+	for _, id := range ids {
+		notification, err := s.GetByID(ctx, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting notification", logging.KeyNotificationID, id, logging.KeyError, err)
 			continue
 		}
 		if notification != nil {
@@ -246,3 +673,269 @@ func (s *RedisStorage) GetPendingNotifications(ctx context.Context) ([]*models.N
 
 	return notifications, nil
 }
+
+func (s *RedisStorage) GetExpired(ctx context.Context, now time.Time) ([]*models.Notification, error) {
+	ids, err := s.client.ZRangeByScore(ctx, s.key(ctx, "notifications:expiring"), &redis.ZRangeBy{
+		Min: "0",
+		Max: fmt.Sprintf("%d", now.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired notifications: %w", err)
+	}
+
+	var notifications []*models.Notification
+	for _, id := range ids {
+		notification, err := s.GetByID(ctx, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting notification", logging.KeyNotificationID, id, logging.KeyError, err)
+			continue
+		}
+		if notification == nil {
+			s.client.ZRem(ctx, s.key(ctx, "notifications:expiring"), id)
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, nil
+}
+
+func (s *RedisStorage) GetLeaseExpired(ctx context.Context, now time.Time) ([]*models.Notification, error) {
+	ids, err := s.client.ZRangeByScore(ctx, s.key(ctx, "notifications:leases"), &redis.ZRangeBy{
+		Min: "0",
+		Max: fmt.Sprintf("%d", now.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired leases: %w", err)
+	}
+
+	var notifications []*models.Notification
+	for _, id := range ids {
+		notification, err := s.GetByID(ctx, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting notification", logging.KeyNotificationID, id, logging.KeyError, err)
+			continue
+		}
+		if notification == nil {
+			s.client.ZRem(ctx, s.key(ctx, "notifications:leases"), id)
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, nil
+}
+
+func (s *RedisStorage) Tenants(ctx context.Context) ([]string, error) {
+	tenants, err := s.client.SMembers(ctx, tenantsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tenants: %w", err)
+	}
+	return tenants, nil
+}
+
+func (s *RedisStorage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
+
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStorage) CountPending(ctx context.Context) (int64, error) {
+	count, err := s.client.ZCard(ctx, s.key(ctx, "notifications:pending")).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count pending notifications: %w", err)
+	}
+	return count, nil
+}
+
+func (s *RedisStorage) StatusCounts(ctx context.Context) (map[models.NotificationStatus]int64, error) {
+	values, err := s.client.HGetAll(ctx, s.key(ctx, "notifications:status")).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status counts: %w", err)
+	}
+	if _, ok := values[statusCountedField]; !ok {
+		return s.rebuildStatusCounts(ctx)
+	}
+
+	counts := make(map[models.NotificationStatus]int64, len(values))
+	for status, value := range values {
+		if status == statusCountedField {
+			continue
+		}
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count %q for status %s: %w", value, status, err)
+		}
+		counts[models.NotificationStatus(status)] = count
+	}
+	return counts, nil
+}
+
+// rebuildStatusCounts counts the tenant's notifications once and stores the
+// result. Writes made meanwhile touch the watched hash and abort the
+// transaction, so the stored counts never miss them.
+func (s *RedisStorage) rebuildStatusCounts(ctx context.Context) (map[models.NotificationStatus]int64, error) {
+	key := s.key(ctx, "notifications:status")
+
+	var counts map[models.NotificationStatus]int64
+	txFn := func(tx *redis.Tx) error {
+		notifications, err := s.GetAll(ctx)
+		if err != nil {
+			return err
+		}
+
+		counts = make(map[models.NotificationStatus]int64)
+		for _, n := range notifications {
+			counts[n.Status]++
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			for status, count := range counts {
+				pipe.HSet(ctx, key, string(status), count)
+			}
+			pipe.HSet(ctx, key, statusCountedField, 1)
+			return nil
+		})
+		return err
+	}
+
+	retryStrategy := wbfretry.Strategy{
+		Attempts: 3,
+		Delay:    100 * time.Millisecond,
+		Backoff:  2,
+	}
+
+	err := wbfretry.DoContext(ctx, retryStrategy, func() error {
+		return s.client.Watch(ctx, txFn, key)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild status counts: %w", err)
+	}
+
+	slog.InfoContext(ctx, "Rebuilt status counts", logging.KeyTenant, tenant.FromContext(ctx))
+	return counts, nil
+}
+
+func (s *RedisStorage) IncrementCounter(ctx context.Context, name string, window time.Duration) (int64, error) {
+	bucket := time.Now().UnixNano() / int64(window)
+	key := s.key(ctx, fmt.Sprintf("counter:%s:%d", name, bucket))
+
+	pipe := s.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	pipe.Expire(ctx, key, window)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to increment counter %s: %w", name, err)
+	}
+	return incr.Val(), nil
+}
+
+func (s *RedisStorage) DecrementCounter(ctx context.Context, name string, window time.Duration, at time.Time) error {
+	bucket := at.UnixNano() / int64(window)
+	key := s.key(ctx, fmt.Sprintf("counter:%s:%d", name, bucket))
+
+	if err := decrementScript.Run(ctx, s.client, []string{key}).Err(); err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to decrement counter %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *RedisStorage) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEntry, error) {
+	now := time.Now()
+	result, err := claimOutboxScript.Run(ctx, s.client,
+		[]string{outboxPendingKey, outboxEntriesKey},
+		now.UnixMilli(), now.Add(lease).UnixMilli(), limit,
+	).Slice()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to claim outbox entries: %w", err)
+	}
+
+	var entries []*models.OutboxEntry
+	for _, item := range result {
+		data, ok := item.(string)
+		if !ok {
+			continue
+		}
+		var entry models.OutboxEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshalling outbox entry", logging.KeyError, err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+func (s *RedisStorage) CompleteOutbox(ctx context.Context, id string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, outboxPendingKey, id)
+		pipe.HDel(ctx, outboxEntriesKey, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete outbox entry: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStorage) ClaimCallbacks(ctx context.Context, limit int, lease time.Duration) ([]*models.CallbackEntry, error) {
+	now := time.Now()
+	result, err := claimOutboxScript.Run(ctx, s.client,
+		[]string{callbackPendingKey, callbackEntriesKey},
+		now.UnixMilli(), now.Add(lease).UnixMilli(), limit,
+	).Slice()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to claim callback entries: %w", err)
+	}
+
+	var entries []*models.CallbackEntry
+	for _, item := range result {
+		data, ok := item.(string)
+		if !ok {
+			continue
+		}
+		var entry models.CallbackEntry
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			slog.ErrorContext(ctx, "Error unmarshalling callback entry", logging.KeyError, err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+func (s *RedisStorage) RetryCallback(ctx context.Context, entry *models.CallbackEntry, at time.Time) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback entry: %w", err)
+	}
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, callbackEntriesKey, entry.ID, data)
+		pipe.ZAdd(ctx, callbackPendingKey, &redis.Z{
+			Score:  float64(at.UnixMilli()),
+			Member: entry.ID,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reschedule callback entry: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisStorage) CompleteCallback(ctx context.Context, id string) error {
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, callbackPendingKey, id)
+		pipe.HDel(ctx, callbackEntriesKey, id)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete callback entry: %w", err)
+	}
+	return nil
+}
@@ -2,14 +2,99 @@ package storage
 
 import (
 	"context"
+	"log/slog"
+	"time"
 
+	"notifier/internal/logging"
 	"notifier/internal/models"
 )
 
+// DueChange is announced whenever a notification's status or due time
+// changes, so schedulers can keep their timers in sync without polling.
+type DueChange struct {
+	TenantID string                    `json:"tenant_id"`
+	ID       string                    `json:"id"`
+	Status   models.NotificationStatus `json:"status"`
+	DueAt    time.Time                 `json:"due_at"`
+}
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeStatus  = "status"
+)
+
+// Change is announced for every write of a notification, for live views.
+// Its type is status when the write changed the status, otherwise created or
+// updated.
+type Change struct {
+	Type           string                    `json:"type"`
+	TenantID       string                    `json:"tenant_id"`
+	Notification   *models.Notification      `json:"notification"`
+	PreviousStatus models.NotificationStatus `json:"previous_status,omitempty"`
+}
+
 type Storage interface {
 	Create(ctx context.Context, notification *models.Notification) error
 	GetByID(ctx context.Context, id string) (*models.Notification, error)
 	Update(ctx context.Context, id string, updateFn func(*models.Notification)) error
+	// UpdateIf applies updateFn atomically and stores the result only if it
+	// returns true. It returns the stored notification, or nil if the
+	// notification does not exist or updateFn declined.
+	UpdateIf(ctx context.Context, id string, updateFn func(*models.Notification) bool) (*models.Notification, error)
 	Delete(ctx context.Context, id string) error
+	AppendEvent(ctx context.Context, id string, event *models.Event) error
+	// GetEvents returns the notification's history, oldest first.
+	GetEvents(ctx context.Context, id string) ([]models.Event, error)
 	GetAll(ctx context.Context) ([]*models.Notification, error)
+	GetExpired(ctx context.Context, now time.Time) ([]*models.Notification, error)
+	// GetDue returns pending and retrying notifications due at or before until.
+	GetDue(ctx context.Context, until time.Time) ([]*models.Notification, error)
+	WatchDue(ctx context.Context) (<-chan DueChange, error)
+	// WatchChanges streams the changes of all tenants until ctx is done.
+	// Changes made while nobody watches are not replayed.
+	WatchChanges(ctx context.Context) (<-chan Change, error)
+	GetLeaseExpired(ctx context.Context, now time.Time) ([]*models.Notification, error)
+	Tenants(ctx context.Context) ([]string, error)
+	CountPending(ctx context.Context) (int64, error)
+	// StatusCounts returns how many of the tenant's notifications are in each
+	// status, from counters kept up to date by every write.
+	StatusCounts(ctx context.Context) (map[models.NotificationStatus]int64, error)
+	IncrementCounter(ctx context.Context, name string, window time.Duration) (int64, error)
+	// DecrementCounter takes back an increment made at the given time, in
+	// the window it was counted in.
+	DecrementCounter(ctx context.Context, name string, window time.Duration, at time.Time) error
+	ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]*models.OutboxEntry, error)
+	CompleteOutbox(ctx context.Context, id string) error
+	// ClaimCallbacks hands out callback entries that are due, hiding them from
+	// other claimants for the lease. Entries are written by the storage itself
+	// whenever a notification reaches a final status.
+	ClaimCallbacks(ctx context.Context, limit int, lease time.Duration) ([]*models.CallbackEntry, error)
+	RetryCallback(ctx context.Context, entry *models.CallbackEntry, at time.Time) error
+	CompleteCallback(ctx context.Context, id string) error
+	// Ping checks that the backing store is reachable.
+	Ping(ctx context.Context) error
+}
+
+// outboxEntryID and callbackEntryID name entries in the outbox and callback
+// queues, which are shared by all tenants while notification IDs are only
+// unique within one.
+func outboxEntryID(tenantID, notificationID string) string {
+	return tenantID + ":" + notificationID
+}
+
+func callbackEntryID(tenantID, notificationID string, status models.NotificationStatus) string {
+	return tenantID + ":" + notificationID + ":" + string(status)
+}
+
+// RecordEvent appends event to the notification's history, logging failures
+// instead of returning them: a lost history entry must never hold up
+// delivery.
+func RecordEvent(ctx context.Context, s Storage, id string, event models.Event) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	if err := s.AppendEvent(ctx, id, &event); err != nil {
+		slog.ErrorContext(ctx, "Failed to record event", "event", event.Type, logging.KeyNotificationID, id, logging.KeyError, err)
+	}
 }
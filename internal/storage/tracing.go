@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"notifier/internal/models"
+	"notifier/internal/tenant"
+	"notifier/internal/tracing"
+)
+
+var tracer = tracing.Tracer("notifier/storage")
+
+// traceCarrier returns the trace context of ctx for storing with an outbox
+// entry.
+func traceCarrier(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	tracing.Inject(ctx, carrier)
+	return carrier
+}
+
+// tracedStorage wraps storage calls made within a trace in a client span.
+// Calls without a parent span, such as the pollers' periodic claims, are not
+// traced so they do not flood the exporter with single-span traces. The
+// watches are long-lived and, like the health check's Ping, are passed
+// through untraced.
+type tracedStorage struct {
+	Storage
+}
+
+func WithTracing(s Storage) Storage {
+	return &tracedStorage{Storage: s}
+}
+
+func (s *tracedStorage) start(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	attrs = append(attrs, attribute.String("tenant.id", tenant.FromContext(ctx)))
+	return tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func notificationID(id string) attribute.KeyValue {
+	return attribute.String("notification.id", id)
+}
+
+func (s *tracedStorage) Create(ctx context.Context, notification *models.Notification) (err error) {
+	ctx, span := s.start(ctx, "Create", notificationID(notification.ID))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.Create(ctx, notification)
+}
+
+func (s *tracedStorage) GetByID(ctx context.Context, id string) (_ *models.Notification, err error) {
+	ctx, span := s.start(ctx, "GetByID", notificationID(id))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.GetByID(ctx, id)
+}
+
+func (s *tracedStorage) Update(ctx context.Context, id string, updateFn func(*models.Notification)) (err error) {
+	ctx, span := s.start(ctx, "Update", notificationID(id))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.Update(ctx, id, updateFn)
+}
+
+func (s *tracedStorage) UpdateIf(ctx context.Context, id string, updateFn func(*models.Notification) bool) (updated *models.Notification, err error) {
+	ctx, span := s.start(ctx, "UpdateIf", notificationID(id))
+	defer func() {
+		span.SetAttributes(attribute.Bool("storage.updated", updated != nil))
+		tracing.End(span, err)
+	}()
+	return s.Storage.UpdateIf(ctx, id, updateFn)
+}
+
+func (s *tracedStorage) Delete(ctx context.Context, id string) (err error) {
+	ctx, span := s.start(ctx, "Delete", notificationID(id))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.Delete(ctx, id)
+}
+
+func (s *tracedStorage) AppendEvent(ctx context.Context, id string, event *models.Event) (err error) {
+	ctx, span := s.start(ctx, "AppendEvent", notificationID(id), attribute.String("event.type", string(event.Type)))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.AppendEvent(ctx, id, event)
+}
+
+func (s *tracedStorage) GetEvents(ctx context.Context, id string) (_ []models.Event, err error) {
+	ctx, span := s.start(ctx, "GetEvents", notificationID(id))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.GetEvents(ctx, id)
+}
+
+func (s *tracedStorage) GetAll(ctx context.Context) (_ []*models.Notification, err error) {
+	ctx, span := s.start(ctx, "GetAll")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.GetAll(ctx)
+}
+
+func (s *tracedStorage) GetExpired(ctx context.Context, now time.Time) (_ []*models.Notification, err error) {
+	ctx, span := s.start(ctx, "GetExpired")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.GetExpired(ctx, now)
+}
+
+func (s *tracedStorage) GetDue(ctx context.Context, until time.Time) (_ []*models.Notification, err error) {
+	ctx, span := s.start(ctx, "GetDue")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.GetDue(ctx, until)
+}
+
+func (s *tracedStorage) GetLeaseExpired(ctx context.Context, now time.Time) (_ []*models.Notification, err error) {
+	ctx, span := s.start(ctx, "GetLeaseExpired")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.GetLeaseExpired(ctx, now)
+}
+
+func (s *tracedStorage) Tenants(ctx context.Context) (_ []string, err error) {
+	ctx, span := s.start(ctx, "Tenants")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.Tenants(ctx)
+}
+
+func (s *tracedStorage) CountPending(ctx context.Context) (_ int64, err error) {
+	ctx, span := s.start(ctx, "CountPending")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.CountPending(ctx)
+}
+
+func (s *tracedStorage) StatusCounts(ctx context.Context) (_ map[models.NotificationStatus]int64, err error) {
+	ctx, span := s.start(ctx, "StatusCounts")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.StatusCounts(ctx)
+}
+
+func (s *tracedStorage) IncrementCounter(ctx context.Context, name string, window time.Duration) (_ int64, err error) {
+	ctx, span := s.start(ctx, "IncrementCounter", attribute.String("counter.name", name))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.IncrementCounter(ctx, name, window)
+}
+
+func (s *tracedStorage) DecrementCounter(ctx context.Context, name string, window time.Duration, at time.Time) (err error) {
+	ctx, span := s.start(ctx, "DecrementCounter", attribute.String("counter.name", name))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.DecrementCounter(ctx, name, window, at)
+}
+
+func (s *tracedStorage) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) (_ []*models.OutboxEntry, err error) {
+	ctx, span := s.start(ctx, "ClaimOutbox")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.ClaimOutbox(ctx, limit, lease)
+}
+
+func (s *tracedStorage) CompleteOutbox(ctx context.Context, id string) (err error) {
+	ctx, span := s.start(ctx, "CompleteOutbox", notificationID(id))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.CompleteOutbox(ctx, id)
+}
+
+func (s *tracedStorage) ClaimCallbacks(ctx context.Context, limit int, lease time.Duration) (_ []*models.CallbackEntry, err error) {
+	ctx, span := s.start(ctx, "ClaimCallbacks")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.ClaimCallbacks(ctx, limit, lease)
+}
+
+func (s *tracedStorage) RetryCallback(ctx context.Context, entry *models.CallbackEntry, at time.Time) (err error) {
+	ctx, span := s.start(ctx, "RetryCallback", notificationID(entry.NotificationID))
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.RetryCallback(ctx, entry, at)
+}
+
+func (s *tracedStorage) CompleteCallback(ctx context.Context, id string) (err error) {
+	ctx, span := s.start(ctx, "CompleteCallback")
+	defer func() { tracing.End(span, err) }()
+	return s.Storage.CompleteCallback(ctx, id)
+}
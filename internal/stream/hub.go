@@ -0,0 +1,161 @@
+package stream
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"notifier/internal/logging"
+	"notifier/internal/models"
+	"notifier/internal/storage"
+)
+
+const (
+	subscriberBuffer = 64
+	rewatchDelay     = time.Second
+)
+
+// Filter selects the changes a subscriber receives. Empty fields match
+// everything.
+type Filter struct {
+	TenantID string
+	Statuses map[models.NotificationStatus]bool
+	Types    map[string]bool
+}
+
+func (f Filter) match(change storage.Change) bool {
+	if f.TenantID != "" && change.TenantID != f.TenantID {
+		return false
+	}
+	if len(f.Statuses) > 0 && !f.Statuses[change.Notification.Status] {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[change.Type] {
+		return false
+	}
+	return true
+}
+
+// Subscription delivers matching changes on C until it is closed. A
+// subscriber that falls behind by more than its buffer is dropped and C is
+// closed, so clients reconnect and reload instead of silently missing
+// changes.
+type Subscription struct {
+	C      <-chan storage.Change
+	ch     chan storage.Change
+	filter Filter
+}
+
+// Hub holds a single storage watch per process and fans the changes out to
+// every connected live view.
+type Hub struct {
+	storage     storage.Storage
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	stopChan    chan struct{}
+}
+
+func NewHub(storage storage.Storage) *Hub {
+	return &Hub{
+		storage:     storage,
+		subscribers: make(map[*Subscription]struct{}),
+		stopChan:    make(chan struct{}),
+	}
+}
+
+func (h *Hub) Start(ctx context.Context) {
+	go h.run(ctx)
+	slog.Info("Change stream hub started")
+}
+
+func (h *Hub) Stop() {
+	close(h.stopChan)
+	slog.Info("Change stream hub stopped")
+}
+
+func (h *Hub) Subscribe(filter Filter) *Subscription {
+	ch := make(chan storage.Change, subscriberBuffer)
+	sub := &Subscription{C: ch, ch: ch, filter: filter}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(sub)
+}
+
+// drop must be called with the lock held.
+func (h *Hub) drop(sub *Subscription) {
+	if _, ok := h.subscribers[sub]; ok {
+		delete(h.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+func (h *Hub) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		changes, err := h.storage.WatchChanges(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to watch notification changes", logging.KeyError, err)
+		} else {
+			for change := range changes {
+				h.publish(change)
+			}
+			slog.WarnContext(ctx, "Notification change subscription closed, resubscribing")
+		}
+
+		// Anyone connected may have missed changes while the watch was down.
+		h.dropAll()
+
+		select {
+		case <-time.After(rewatchDelay):
+		case <-h.stopChan:
+			h.dropAll()
+			return
+		case <-ctx.Done():
+			h.dropAll()
+			return
+		}
+	}
+}
+
+func (h *Hub) publish(change storage.Change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		if !sub.filter.match(change) {
+			continue
+		}
+		select {
+		case sub.ch <- change:
+		default:
+			slog.Warn("Dropping slow change stream subscriber")
+			h.drop(sub)
+		}
+	}
+}
+
+func (h *Hub) dropAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		h.drop(sub)
+	}
+}
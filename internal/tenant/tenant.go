@@ -0,0 +1,145 @@
+package tenant
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const Default = "default"
+
+type ctxKey struct{}
+
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+func FromContext(ctx context.Context) string {
+	if id, ok := ctx.Value(ctxKey{}).(string); ok && id != "" {
+		return id
+	}
+	return Default
+}
+
+type Quota struct {
+	MaxPending     int
+	SendsPerMinute int
+}
+
+// Config holds the API keys, mapped to the tenant they belong to, the admin
+// keys for the operator endpoints that span tenants, the quota of tenants
+// without an override and the per-tenant overrides. Zero means unlimited.
+type Config struct {
+	Keys         map[string]string
+	AdminKeys    []string
+	DefaultQuota Quota
+	Quotas       map[string]Quota
+}
+
+// Registry resolves API keys to tenants and tenants to their quota. Quotas
+// can be replaced while it is in use; keys are fixed at creation.
+type Registry struct {
+	keys      map[string]string
+	adminKeys map[string]bool
+
+	mu           sync.RWMutex
+	quotas       map[string]Quota
+	defaultQuota Quota
+}
+
+func NewRegistry(config Config) *Registry {
+	r := &Registry{keys: config.Keys, adminKeys: make(map[string]bool)}
+	if r.keys == nil {
+		r.keys = make(map[string]string)
+	}
+	for _, key := range config.AdminKeys {
+		r.adminKeys[key] = true
+	}
+	r.SetQuotas(config)
+	return r
+}
+
+// SetQuotas replaces the default quota and the overrides with config's.
+func (r *Registry) SetQuotas(config Config) {
+	quotas := config.Quotas
+	if quotas == nil {
+		quotas = make(map[string]Quota)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.quotas = quotas
+	r.defaultQuota = config.DefaultQuota
+}
+
+// ParseKeys parses "key:tenant" entries.
+func ParseKeys(entries []string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range entries {
+		key, id, ok := strings.Cut(pair, ":")
+		if !ok || key == "" || id == "" {
+			return nil, fmt.Errorf("invalid API key entry %q", pair)
+		}
+		keys[key] = id
+	}
+	return keys, nil
+}
+
+// ParseQuotas parses "tenant=maxPending/sendsPerMinute" entries; the sends
+// per minute may be left out.
+func ParseQuotas(entries []string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	for _, entry := range entries {
+		id, limits, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tenant quota entry %q", entry)
+		}
+		pending, perMinute, _ := strings.Cut(limits, "/")
+		var quota Quota
+		var err error
+		if quota.MaxPending, err = strconv.Atoi(pending); err != nil {
+			return nil, fmt.Errorf("invalid tenant quota entry %q: %w", entry, err)
+		}
+		if perMinute != "" {
+			if quota.SendsPerMinute, err = strconv.Atoi(perMinute); err != nil {
+				return nil, fmt.Errorf("invalid tenant quota entry %q: %w", entry, err)
+			}
+		}
+		quotas[id] = quota
+	}
+	return quotas, nil
+}
+
+// AuthRequired reports whether callers must present an API key. Without
+// configured keys every request belongs to the default tenant.
+func (r *Registry) AuthRequired() bool {
+	return len(r.keys) > 0
+}
+
+func (r *Registry) Lookup(apiKey string) (string, bool) {
+	if !r.AuthRequired() {
+		return Default, true
+	}
+	id, ok := r.keys[apiKey]
+	return id, ok
+}
+
+// IsAdmin reports whether apiKey may use the operator endpoints. Without any
+// configured keys, as in single-tenant setups, everyone may.
+func (r *Registry) IsAdmin(apiKey string) bool {
+	if !r.AuthRequired() && len(r.adminKeys) == 0 {
+		return true
+	}
+	return r.adminKeys[apiKey]
+}
+
+func (r *Registry) Quota(id string) Quota {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if quota, ok := r.quotas[id]; ok {
+		return quota
+	}
+	return r.defaultQuota
+}
@@ -0,0 +1,179 @@
+package timingwheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Wheel is a hierarchical timing wheel. Level 0 has slots of one tick, each
+// higher level has slots as long as a whole turn of the level below. Entries
+// far in the future sit in a coarse slot and cascade down to finer levels as
+// their slot comes up, so scheduling, cancelling and each tick cost O(1)
+// regardless of how many entries are waiting.
+//
+// Slots are aligned to absolute time and due times are rounded up to the
+// next tick, so an entry never fires before its due time and at most one
+// tick after it.
+type Wheel struct {
+	tick   time.Duration
+	slots  int64
+	levels []*level
+	fire   func(key string)
+
+	mu       sync.Mutex
+	current  int64 // current tick number since the Unix epoch
+	entries  map[string]*entry
+	stopChan chan struct{}
+}
+
+type level struct {
+	span    int64 // ticks covered by one slot
+	buckets []map[string]*entry
+}
+
+type entry struct {
+	key   string
+	due   int64 // tick number the entry fires on
+	level int
+	slot  int64
+}
+
+// New creates a wheel with the given tick, slots per level and number of
+// levels. fire is called from the wheel's goroutine, without the wheel's lock
+// held, for every entry that comes due.
+func New(tick time.Duration, slots, levels int, fire func(key string)) *Wheel {
+	w := &Wheel{
+		tick:     tick,
+		slots:    int64(slots),
+		fire:     fire,
+		current:  time.Now().UnixNano() / int64(tick),
+		entries:  make(map[string]*entry),
+		stopChan: make(chan struct{}),
+	}
+
+	span := int64(1)
+	for i := 0; i < levels; i++ {
+		l := &level{span: span, buckets: make([]map[string]*entry, slots)}
+		for j := range l.buckets {
+			l.buckets[j] = make(map[string]*entry)
+		}
+		w.levels = append(w.levels, l)
+		span *= int64(slots)
+	}
+	return w
+}
+
+// Horizon is how far ahead the wheel can hold entries.
+func (w *Wheel) Horizon() time.Duration {
+	return time.Duration(w.levels[len(w.levels)-1].span*w.slots) * w.tick
+}
+
+func (w *Wheel) Start() {
+	go w.run()
+}
+
+func (w *Wheel) Stop() {
+	close(w.stopChan)
+}
+
+// Schedule adds the key at time at, replacing any earlier schedule for it.
+// Keys already due fire on the next tick. It returns false if at lies beyond
+// the horizon.
+func (w *Wheel) Schedule(key string, at time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.remove(key)
+
+	due := (at.UnixNano() + int64(w.tick) - 1) / int64(w.tick)
+	if due <= w.current {
+		due = w.current + 1
+	}
+	return w.place(&entry{key: key, due: due})
+}
+
+// Cancel removes the key if it is scheduled.
+func (w *Wheel) Cancel(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.remove(key)
+}
+
+func (w *Wheel) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.entries)
+}
+
+// place puts the entry on the finest level whose turn still reaches its due
+// tick. On higher levels the entry's slot always lies ahead of the current
+// one, so it is cascaded down before it is due.
+func (w *Wheel) place(e *entry) bool {
+	for i, l := range w.levels {
+		if e.due/l.span-w.current/l.span < w.slots {
+			e.level = i
+			e.slot = (e.due / l.span) % w.slots
+			l.buckets[e.slot][e.key] = e
+			w.entries[e.key] = e
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Wheel) remove(key string) {
+	if e, ok := w.entries[key]; ok {
+		delete(w.levels[e.level].buckets[e.slot], key)
+		delete(w.entries, key)
+	}
+}
+
+func (w *Wheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, key := range w.advance(time.Now()) {
+				w.fire(key)
+			}
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// advance moves the wheel up to now, cascading higher level slots as their
+// time comes, and returns the keys that came due.
+func (w *Wheel) advance(now time.Time) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var due []string
+	target := now.UnixNano() / int64(w.tick)
+	for w.current < target {
+		w.current++
+
+		for i := len(w.levels) - 1; i > 0; i-- {
+			l := w.levels[i]
+			if w.current%l.span != 0 {
+				continue
+			}
+			bucket := l.buckets[(w.current/l.span)%w.slots]
+			for key, e := range bucket {
+				delete(bucket, key)
+				delete(w.entries, key)
+				w.place(e)
+			}
+		}
+
+		bucket := w.levels[0].buckets[w.current%w.slots]
+		for key := range bucket {
+			delete(bucket, key)
+			delete(w.entries, key)
+			due = append(due, key)
+		}
+	}
+	return due
+}
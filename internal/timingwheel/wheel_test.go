@@ -0,0 +1,148 @@
+package timingwheel
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// With a 1ms tick, 4 slots and 3 levels the levels' slots span 1, 4 and 16
+// ticks and the horizon is 64 ticks.
+const (
+	testTick   = time.Millisecond
+	testSlots  = 4
+	testLevels = 3
+)
+
+// newTestWheel returns a wheel that is not running, positioned at tick
+// start, and driven by advance.
+func newTestWheel(start int64) *Wheel {
+	w := New(testTick, testSlots, testLevels, func(string) {})
+	w.current = start
+	return w
+}
+
+func at(tick int64) time.Time {
+	return time.Unix(0, tick*int64(testTick))
+}
+
+// advanceTo moves the wheel tick by tick up to end and returns the tick
+// each key fired on.
+func advanceTo(w *Wheel, end int64) map[string]int64 {
+	fired := make(map[string]int64)
+	for tick := w.current + 1; tick <= end; tick++ {
+		for _, key := range w.advance(at(tick)) {
+			fired[key] = tick
+		}
+	}
+	return fired
+}
+
+func TestHorizon(t *testing.T) {
+	if got, want := newTestWheel(0).Horizon(), 64*testTick; got != want {
+		t.Errorf("Horizon() = %v, want %v", got, want)
+	}
+}
+
+// Every due tick within the horizon, from starts on and between the
+// boundaries of the higher levels, fires on exactly that tick after however
+// many cascades it takes.
+func TestFiresOnDueTickAcrossCascades(t *testing.T) {
+	for _, start := range []int64{0, 1, 3, 4, 5, 15, 16, 17, 63, 64, 1000} {
+		for offset := int64(1); offset < 48; offset++ {
+			w := newTestWheel(start)
+			due := start + offset
+			if !w.Schedule("key", at(due)) {
+				t.Errorf("start %d: Schedule(%d) = false, want true", start, due)
+				continue
+			}
+
+			fired := advanceTo(w, start+64)
+			if got, ok := fired["key"]; !ok || got != due {
+				t.Errorf("start %d: key due at %d fired %v, want at %d", start, due, fired, due)
+			}
+			if w.Len() != 0 {
+				t.Errorf("start %d, due %d: %d entries left after firing", start, due, w.Len())
+			}
+		}
+	}
+}
+
+func TestDueTimeIsRoundedUpToTheNextTick(t *testing.T) {
+	w := newTestWheel(0)
+	w.Schedule("key", at(5).Add(testTick/2))
+
+	if fired := advanceTo(w, 5); len(fired) != 0 {
+		t.Fatalf("fired before the due time: %v", fired)
+	}
+	if fired := advanceTo(w, 6); fired["key"] != 6 {
+		t.Errorf("fired = %v, want key at 6", fired)
+	}
+}
+
+func TestPastDueFiresOnNextTick(t *testing.T) {
+	w := newTestWheel(10)
+	w.Schedule("key", at(3))
+
+	if fired := advanceTo(w, 11); fired["key"] != 11 {
+		t.Errorf("fired = %v, want key at 11", fired)
+	}
+}
+
+func TestScheduleBeyondHorizon(t *testing.T) {
+	w := newTestWheel(0)
+	if w.Schedule("key", at(64)) {
+		t.Error("Schedule beyond the horizon = true, want false")
+	}
+	if w.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", w.Len())
+	}
+}
+
+func TestScheduleReplacesEarlierSchedule(t *testing.T) {
+	w := newTestWheel(0)
+	w.Schedule("key", at(10))
+	w.Schedule("key", at(40))
+
+	fired := advanceTo(w, 64)
+	if len(fired) != 1 || fired["key"] != 40 {
+		t.Errorf("fired = %v, want key only at 40", fired)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	// An entry due at 47 is placed on level 2, cascades to level 1 at 32 and
+	// to level 0 at 44; it is cancelled on each of them.
+	for _, cancelAt := range []int64{0, 33, 46} {
+		w := newTestWheel(0)
+		w.Schedule("cancelled", at(47))
+		w.Schedule("kept", at(47))
+
+		fired := advanceTo(w, cancelAt)
+		w.Cancel("cancelled")
+		for key, tick := range advanceTo(w, 64) {
+			fired[key] = tick
+		}
+
+		keys := make([]string, 0, len(fired))
+		for key := range fired {
+			keys = append(keys, key)
+		}
+		if !slices.Equal(keys, []string{"kept"}) {
+			t.Errorf("cancelled at %d: fired %v, want only kept", cancelAt, fired)
+		}
+		if w.Len() != 0 {
+			t.Errorf("cancelled at %d: Len() = %d, want 0", cancelAt, w.Len())
+		}
+	}
+}
+
+func TestCancelUnknownKey(t *testing.T) {
+	w := newTestWheel(0)
+	w.Schedule("key", at(5))
+	w.Cancel("other")
+
+	if fired := advanceTo(w, 5); fired["key"] != 5 {
+		t.Errorf("fired = %v, want key at 5", fired)
+	}
+}
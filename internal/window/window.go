@@ -0,0 +1,115 @@
+package window
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"notifier/internal/models"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type spec struct {
+	start    time.Duration
+	end      time.Duration
+	location *time.Location
+	days     map[time.Weekday]bool
+}
+
+func Validate(w *models.DeliveryWindow) error {
+	_, err := parse(w)
+	return err
+}
+
+// Next returns the earliest moment at or after t that falls inside the
+// delivery window. A nil window allows every moment.
+func Next(w *models.DeliveryWindow, t time.Time) (time.Time, error) {
+	if w == nil {
+		return t, nil
+	}
+
+	s, err := parse(w)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	local := t.In(s.location)
+	year, month, day := local.Date()
+
+	// Start one day back so an overnight window opened yesterday is found.
+	for offset := -1; offset <= 7; offset++ {
+		date := time.Date(year, month, day+offset, 0, 0, 0, 0, s.location)
+		if len(s.days) > 0 && !s.days[date.Weekday()] {
+			continue
+		}
+
+		opens := at(date, s.start)
+		closes := at(date, s.end)
+		if s.end <= s.start {
+			closes = at(date.AddDate(0, 0, 1), s.end)
+		}
+
+		if local.Before(closes) {
+			if local.Before(opens) {
+				return opens, nil
+			}
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("delivery window never opens")
+}
+
+func parse(w *models.DeliveryWindow) (*spec, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window start: %w", err)
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window end: %w", err)
+	}
+
+	location := time.UTC
+	if w.Timezone != "" {
+		if location, err = time.LoadLocation(w.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid window timezone: %w", err)
+		}
+	}
+
+	s := &spec{start: start, end: end, location: location}
+	for _, name := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(name)[:min(3, len(name))]]
+		if !ok {
+			return nil, fmt.Errorf("invalid window day %q", name)
+		}
+		if s.days == nil {
+			s.days = make(map[time.Weekday]bool)
+		}
+		s.days[weekday] = true
+	}
+
+	return s, nil
+}
+
+func parseClock(value string) (time.Duration, error) {
+	clock, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute, nil
+}
+
+func at(date time.Time, offset time.Duration) time.Time {
+	year, month, day := date.Date()
+	return time.Date(year, month, day, int(offset/time.Hour), int(offset%time.Hour/time.Minute), 0, 0, date.Location())
+}
@@ -0,0 +1,89 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"notifier/internal/breaker"
+	"notifier/internal/callback"
+	"notifier/internal/health"
+	"notifier/internal/leader"
+	"notifier/internal/queue"
+	"notifier/internal/ratelimit"
+	"notifier/internal/retrypolicy"
+	"notifier/internal/storage"
+)
+
+const DefaultSweepInterval = 30 * time.Second
+
+// Config holds the scheduler's look-ahead and how often it reloads the wheel
+// from storage, and how often the sweeper runs. Zero values use the
+// defaults.
+type Config struct {
+	Lookahead     time.Duration
+	Tick          time.Duration
+	SweepInterval time.Duration
+}
+
+func (c Config) Validate() error {
+	if c.Lookahead < 0 || c.Lookahead > MaxLookahead {
+		return fmt.Errorf("scheduler lookahead must be a duration up to %v, got %v", MaxLookahead, c.Lookahead)
+	}
+	lookahead := c.Lookahead
+	if lookahead == 0 {
+		lookahead = DefaultLookahead
+	}
+	if c.Tick < 0 || c.Tick >= lookahead {
+		return fmt.Errorf("scheduler tick must be shorter than the lookahead %v, got %v", lookahead, c.Tick)
+	}
+	if c.SweepInterval < 0 {
+		return fmt.Errorf("sweeper interval must not be negative, got %v", c.SweepInterval)
+	}
+	return nil
+}
+
+// StartAll starts the scheduler, sweeper, callback dispatcher and processor
+// and returns a function that stops them, draining the processor until ctx
+// passed to it is done. The scheduler works on the shards it holds through
+// shards; the sweeper and dispatcher only run on the replica elected by
+// maintenance, a single-shard coordinator. It is used by cmd/worker and by
+// cmd/api when the in-memory queue runs everything in a single binary. The
+// scheduler's tick and the queue's consumers are added to checks as
+// liveness checks.
+func StartAll(ctx context.Context, store storage.Storage, q queue.Queue, limiter *ratelimit.Limiter,
+	shards, maintenance *leader.Coordinator, config Config, policies *retrypolicy.Registry, breakers *breaker.Registry,
+	subscriptions callback.Subscriptions, checks *health.Checker) (func(context.Context) error, error) {
+	scheduler := NewScheduler(store, q, shards, config.Lookahead, config.Tick)
+	scheduler.Start(ctx)
+
+	maintenance.Start(ctx)
+	sweeper := NewSweeper(store, q, maintenance, config.SweepInterval)
+	sweeper.Start(ctx)
+
+	callbacks := callback.NewDispatcher(store, subscriptions, maintenance)
+	callbacks.Start(ctx)
+
+	processor := NewProcessor(store, q, limiter, policies, breakers)
+	if err := processor.Start(ctx); err != nil {
+		scheduler.Stop()
+		sweeper.Stop()
+		callbacks.Stop()
+		maintenance.Stop()
+		return nil, fmt.Errorf("failed to start processor: %w", err)
+	}
+
+	checks.AddLive("scheduler", scheduler.Check)
+	if h, ok := q.(queue.Health); ok {
+		checks.AddLive("consumers", func(context.Context) error { return h.ConsumersRunning() })
+	}
+
+	return func(ctx context.Context) error {
+		err := processor.Shutdown(ctx)
+		callbacks.Stop()
+		sweeper.Stop()
+		maintenance.Stop()
+		scheduler.Stop()
+		return err
+	}, nil
+}
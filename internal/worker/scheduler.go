@@ -2,47 +2,156 @@ package worker
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/wb-go/wbf/retry"
+	"notifier/internal/leader"
+	"notifier/internal/logging"
+	"notifier/internal/metrics"
 	"notifier/internal/models"
 	"notifier/internal/queue"
 	"notifier/internal/storage"
+	"notifier/internal/tenant"
+	"notifier/internal/timingwheel"
 )
 
+// republishInterval is how long a notification may stay due before the
+// scheduler publishes it, giving the broker's own delivery time to be claimed,
+// and then how long before it publishes it again, in case that publish was
+// lost too.
+const republishInterval = time.Minute
+
+const (
+	DefaultLookahead = time.Minute
+	MaxLookahead     = 24 * time.Hour
+
+	// A 10ms tick with 64 slots on 4 levels reaches about 46 hours ahead.
+	wheelTick   = 10 * time.Millisecond
+	wheelSlots  = 64
+	wheelLevels = 4
+)
+
+// Scheduler keeps the pending and retrying notifications that come due within
+// the look-ahead in a timing wheel and republishes each one that is still
+// pending or retrying republishInterval after it came due, and again every
+// republishInterval until a worker claims it. The broker delivers the original
+// publish at the due time, so only publishes that were lost are repeated; the
+// worker's claim lets one delivery through should both arrive.
+// The wheel is loaded from storage's due index on start and every half
+// look-ahead, and kept current in between by storage's due changes; nothing
+// is persisted beyond what storage already holds. It only acts on the shards
+// it holds through the coordinator, so replicas never republish the same
+// notifications.
 type Scheduler struct {
-	storage  storage.Storage
-	queue    *queue.Manager
-	stopChan chan struct{}
+	storage   storage.Storage
+	queue     queue.Queue
+	shards    *leader.Coordinator
+	lookahead time.Duration
+	tick      time.Duration
+	wheel     *timingwheel.Wheel
+	due       chan string
+	stopChan  chan struct{}
+
+	// published holds when each notification republished by this replica
+	// may be republished again. It is only used by the run loop.
+	published map[string]time.Time
+	done      chan struct{}
+
+	// lastTick is when the run loop last reloaded, in Unix nanoseconds.
+	lastTick atomic.Int64
 }
 
-func NewScheduler(storage storage.Storage, queue *queue.Manager) *Scheduler {
-	return &Scheduler{
-		storage:  storage,
-		queue:    queue,
-		stopChan: make(chan struct{}),
+// NewScheduler reloads the wheel every tick, half the look-ahead if zero.
+func NewScheduler(storage storage.Storage, queue queue.Queue, shards *leader.Coordinator, lookahead, tick time.Duration) *Scheduler {
+	if lookahead <= 0 {
+		lookahead = DefaultLookahead
+	}
+	if tick <= 0 {
+		tick = lookahead / 2
 	}
+
+	s := &Scheduler{
+		storage:   storage,
+		queue:     queue,
+		shards:    shards,
+		lookahead: lookahead,
+		tick:      tick,
+		due:       make(chan string, 1024),
+		published: make(map[string]time.Time),
+		stopChan:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.wheel = timingwheel.New(wheelTick, wheelSlots, wheelLevels, func(key string) {
+		select {
+		case s.due <- key:
+		case <-s.stopChan:
+		}
+	})
+	return s
 }
 
 func (s *Scheduler) Start(ctx context.Context) {
+	s.shards.Start(ctx)
+	s.wheel.Start()
+	s.lastTick.Store(time.Now().UnixNano())
 	go s.run(ctx)
-	log.Println("Scheduler started")
+	slog.Info("Scheduler started")
 }
 
+// Stop waits for a republish in progress before stopping the wheel and
+// giving up the shards.
 func (s *Scheduler) Stop() {
 	close(s.stopChan)
-	log.Println("Scheduler stopped")
+	<-s.done
+	s.wheel.Stop()
+	s.shards.Stop()
+	slog.Info("Scheduler stopped")
+}
+
+// Check fails once the run loop has missed two reloads, e.g. because it is
+// stuck publishing, so the process can be restarted.
+func (s *Scheduler) Check(ctx context.Context) error {
+	last := s.lastTick.Load()
+	if last == 0 {
+		return errors.New("scheduler is not running")
+	}
+	if age := time.Since(time.Unix(0, last)); age > 2*s.tick {
+		return fmt.Errorf("scheduler last ticked %v ago", age.Round(time.Second))
+	}
+	return nil
 }
 
 func (s *Scheduler) run(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second)
+	defer close(s.done)
+
+	changes := s.watch(ctx)
+	s.hydrate(ctx)
+
+	ticker := time.NewTicker(s.tick)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			s.checkPendingNotifications(ctx)
+			s.lastTick.Store(time.Now().UnixNano())
+			if changes == nil {
+				changes = s.watch(ctx)
+			}
+			s.hydrate(ctx)
+		case change, ok := <-changes:
+			if !ok {
+				slog.WarnContext(ctx, "Due change subscription closed, relying on reloads until it is restored")
+				changes = nil
+				continue
+			}
+			s.track(change)
+		case key := <-s.due:
+			s.fire(ctx, key)
 		case <-s.stopChan:
 			return
 		case <-ctx.Done():
@@ -51,43 +160,149 @@ func (s *Scheduler) run(ctx context.Context) {
 	}
 }
 
-func (s *Scheduler) checkPendingNotifications(ctx context.Context) {
+func (s *Scheduler) watch(ctx context.Context) <-chan storage.DueChange {
+	changes, err := s.storage.WatchDue(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to watch due changes", logging.KeyError, err)
+		return nil
+	}
+	return changes
+}
+
+// hydrate loads every owned notification that comes due within the
+// look-ahead into the wheel.
+func (s *Scheduler) hydrate(ctx context.Context) {
+	if !s.shards.Confirm(ctx) {
+		return
+	}
+
+	tenants, err := s.storage.Tenants(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting tenants", logging.KeyError, err)
+		return
+	}
+
+	until := time.Now().Add(s.lookahead)
+	for _, tenantID := range tenants {
+		notifications, err := s.storage.GetDue(tenant.WithTenant(ctx, tenantID), until)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting due notifications", logging.KeyTenant, tenantID, logging.KeyError, err)
+			continue
+		}
+
+		for _, notification := range notifications {
+			s.track(storage.DueChange{
+				TenantID: tenantID,
+				ID:       notification.ID,
+				Status:   notification.Status,
+				DueAt:    notification.DueAt(),
+			})
+		}
+	}
+}
+
+func (s *Scheduler) track(change storage.DueChange) {
+	key := wheelKey(change.TenantID, change.ID)
+	if !scheduled(change.Status) || !s.shards.Owns(change.ID) {
+		delete(s.published, key)
+		s.wheel.Cancel(key)
+		return
+	}
+
+	if change.DueAt.After(time.Now().Add(s.lookahead)) {
+		s.wheel.Cancel(key)
+		return
+	}
+	s.wheel.Schedule(key, s.fireAt(key, change.DueAt))
+}
+
+// scheduled reports whether the scheduler republishes notifications in the
+// status once they are due: pending ones whose publish may have been lost,
+// and retrying ones whose retry publish may have failed.
+func scheduled(status models.NotificationStatus) bool {
+	return status == models.StatusPending || status == models.StatusRetrying
+}
+
+// fireAt is when a notification due at dueAt is republished: once the broker
+// had republishInterval to deliver it, and not before this replica's last
+// republish may be repeated.
+func (s *Scheduler) fireAt(key string, dueAt time.Time) time.Time {
+	fireAt := dueAt.Add(republishInterval)
+	if next, ok := s.published[key]; ok && next.After(fireAt) {
+		return next
+	}
+	return fireAt
+}
+
+func (s *Scheduler) fire(ctx context.Context, key string) {
+	tenantID, id := splitWheelKey(key)
+	if !s.shards.Owns(id) {
+		delete(s.published, key)
+		return
+	}
+	ctx = tenant.WithTenant(ctx, tenantID)
+	ctx = logging.With(ctx,
+		slog.String(logging.KeyNotificationID, id),
+		slog.String(logging.KeyTenant, tenantID),
+	)
+
+	notification, err := s.storage.GetByID(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting notification", logging.KeyError, err)
+		return
+	}
+
+	now := time.Now()
+	if notification == nil || !scheduled(notification.Status) || notification.Expired(now) {
+		delete(s.published, key)
+		return
+	}
+	if fireAt := s.fireAt(key, notification.DueAt()); fireAt.After(now) {
+		s.wheel.Schedule(key, fireAt)
+		return
+	}
+
+	// A replica that stalled past its lease stops here rather than publish
+	// alongside the shard's new owner; a stall after this check may still
+	// publish twice, which the worker's claim absorbs.
+	if !s.shards.Confirm(ctx) || !s.shards.Owns(id) {
+		delete(s.published, key)
+		return
+	}
+
+	// Until a worker claims it, the notification stays due; check it again
+	// after the interval whether or not this publish succeeds.
+	s.published[key] = now.Add(republishInterval)
+	s.wheel.Schedule(key, s.published[key])
+
 	retryStrategy := retry.Strategy{
 		Attempts: 3,
 		Delay:    100 * time.Millisecond,
 		Backoff:  2,
 	}
 
-	var notifications []*models.Notification
-	err := retry.DoContext(ctx, retryStrategy, func() error {
-		var getErr error
-		notifications, getErr = s.storage.GetAll(ctx)
-		return getErr
+	publishErr := retry.DoContext(ctx, retryStrategy, func() error {
+		return s.queue.PublishImmediate(ctx, notification)
 	})
-
-	if err != nil {
-		log.Printf("Error getting notifications: %v", err)
+	if publishErr != nil {
+		slog.ErrorContext(ctx, "Failed to publish notification", logging.KeyError, publishErr)
 		return
 	}
+	metrics.Published.WithLabelValues(actorScheduler).Inc()
 
-	now := time.Now()
-	for _, notification := range notifications {
-		if notification.Status == models.StatusPending &&
-			notification.SendAt.Before(now) &&
-			notification.SendAt.After(now.Add(-24*time.Hour)) {
+	storage.RecordEvent(ctx, s.storage, id, models.Event{
+		Type:   models.EventPublished,
+		Actor:  actorScheduler,
+		Detail: "still " + string(notification.Status) + " after it came due",
+	})
+}
 
-			publishErr := retry.DoContext(ctx, retryStrategy, func() error {
-				return s.queue.PublishImmediate(ctx, notification)
-			})
+// Notification IDs never contain a colon, tenant IDs may.
+func wheelKey(tenantID, id string) string {
+	return tenantID + ":" + id
+}
 
-			if publishErr != nil {
-				log.Printf("Failed to publish notification %s: %v", notification.ID, publishErr)
-			} else {
-				s.storage.Update(ctx, notification.ID, func(n *models.Notification) {
-					n.Status = models.StatusRetrying
-					n.UpdatedAt = time.Now()
-				})
-			}
-		}
-	}
+func splitWheelKey(key string) (string, string) {
+	i := strings.LastIndex(key, ":")
+	return key[:i], key[i+1:]
 }
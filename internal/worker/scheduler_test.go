@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFireAtLeavesTheBrokerAGracePeriod(t *testing.T) {
+	dueAt := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		published map[string]time.Time
+		want      time.Time
+	}{
+		{
+			name: "not republished yet",
+			want: dueAt.Add(republishInterval),
+		},
+		{
+			name:      "republished before the due time moved",
+			published: map[string]time.Time{"acme:n1": dueAt.Add(-time.Hour)},
+			want:      dueAt.Add(republishInterval),
+		},
+		{
+			name:      "republished recently",
+			published: map[string]time.Time{"acme:n1": dueAt.Add(90 * time.Second)},
+			want:      dueAt.Add(90 * time.Second),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Scheduler{published: tt.published}
+			if got := s.fireAt("acme:n1", dueAt); !got.Equal(tt.want) {
+				t.Errorf("fireAt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package worker
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"notifier/internal/leader"
+	"notifier/internal/logging"
+	"notifier/internal/metrics"
+	"notifier/internal/models"
+	"notifier/internal/queue"
+	"notifier/internal/storage"
+	"notifier/internal/tenant"
+)
+
+// Sweeper moves pending and retrying notifications past their deadline to
+// the expired status so they are never delivered late, and recovers
+// notifications whose worker died while holding the claim. Only the replica
+// holding the coordinator's lock sweeps.
+type Sweeper struct {
+	storage     storage.Storage
+	queue       queue.Queue
+	coordinator *leader.Coordinator
+	interval    time.Duration
+	stopChan    chan struct{}
+	done        chan struct{}
+}
+
+// NewSweeper sweeps while coordinator, which the caller starts and stops,
+// holds its lock.
+func NewSweeper(storage storage.Storage, queue queue.Queue, coordinator *leader.Coordinator, interval time.Duration) *Sweeper {
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	return &Sweeper{
+		storage:     storage,
+		queue:       queue,
+		coordinator: coordinator,
+		interval:    interval,
+		stopChan:    make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (s *Sweeper) Start(ctx context.Context) {
+	go s.run(ctx)
+	slog.Info("Sweeper started")
+}
+
+// Stop waits for a sweep in progress to finish.
+func (s *Sweeper) Stop() {
+	close(s.stopChan)
+	<-s.done
+	slog.Info("Sweeper stopped")
+}
+
+func (s *Sweeper) run(ctx context.Context) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep(ctx)
+		case <-s.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Sweeper) sweep(ctx context.Context) {
+	if !s.coordinator.Confirm(ctx) {
+		return
+	}
+
+	tenants, err := s.storage.Tenants(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting tenants", logging.KeyError, err)
+		return
+	}
+
+	now := time.Now()
+	for _, tenantID := range tenants {
+		tenantCtx := logging.With(tenant.WithTenant(ctx, tenantID), slog.String(logging.KeyTenant, tenantID))
+
+		notifications, err := s.storage.GetExpired(tenantCtx, now)
+		if err != nil {
+			slog.ErrorContext(tenantCtx, "Error getting expired notifications", logging.KeyError, err)
+			continue
+		}
+
+		for _, notification := range notifications {
+			if err := expire(tenantCtx, s.storage, notification.ID, actorSweeper); err != nil {
+				slog.ErrorContext(tenantCtx, "Failed to expire notification", logging.KeyNotificationID, notification.ID, logging.KeyError, err)
+			}
+		}
+
+		s.recoverLeases(tenantCtx, now)
+	}
+}
+
+// recoverLeases counts an attempt whose lease ran out as made, since the
+// worker may have sent before it died, and schedules the next one. A
+// recovered notification is retrying and due at once, so if the publish here
+// fails the scheduler republishes it.
+func (s *Sweeper) recoverLeases(ctx context.Context, now time.Time) {
+	notifications, err := s.storage.GetLeaseExpired(ctx, now)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error getting expired leases", logging.KeyError, err)
+		return
+	}
+
+	for _, notification := range notifications {
+		recovered, err := s.storage.UpdateIf(ctx, notification.ID, func(n *models.Notification) bool {
+			if n.Status != models.StatusSending || n.LeaseUntil == nil || n.LeaseUntil.After(now) {
+				return false
+			}
+
+			n.Attempts++
+			n.LeaseUntil = nil
+			n.NextRetry = nil
+			if n.Attempts >= n.MaxRetries {
+				n.Status = models.StatusFailed
+			} else {
+				n.Status = models.StatusRetrying
+				n.EffectiveSendAt = &now
+			}
+			return true
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to recover notification", logging.KeyNotificationID, notification.ID, logging.KeyError, err)
+			continue
+		}
+		if recovered == nil {
+			continue
+		}
+
+		slog.WarnContext(ctx, "Recovered notification from expired lease",
+			logging.KeyNotificationID, recovered.ID, logging.KeyAttempt, recovered.Attempts,
+			"attempt_id", recovered.AttemptID, "status", recovered.Status)
+		storage.RecordEvent(ctx, s.storage, recovered.ID, models.Event{
+			Type:      models.EventAttemptFailed,
+			Actor:     actorSweeper,
+			Attempt:   recovered.Attempts,
+			AttemptID: recovered.AttemptID,
+			Error:     "lease expired before the attempt finished",
+		})
+
+		if recovered.Status == models.StatusFailed {
+			metrics.Failed.WithLabelValues(recovered.Channel, metrics.ReasonLeaseExpired).Inc()
+			storage.RecordEvent(ctx, s.storage, recovered.ID, models.Event{
+				Type:    models.EventFailed,
+				Actor:   actorSweeper,
+				Attempt: recovered.Attempts,
+			})
+		}
+
+		if recovered.Status == models.StatusRetrying {
+			if err := s.queue.PublishImmediate(ctx, recovered); err != nil {
+				slog.ErrorContext(ctx, "Failed to republish recovered notification, leaving it to the scheduler",
+					logging.KeyNotificationID, recovered.ID, logging.KeyError, err)
+				continue
+			}
+			metrics.Published.WithLabelValues(actorSweeper).Inc()
+			storage.RecordEvent(ctx, s.storage, recovered.ID, models.Event{
+				Type:  models.EventPublished,
+				Actor: actorSweeper,
+			})
+		}
+	}
+}
+
+func expire(ctx context.Context, store storage.Storage, id, actor string) error {
+	expired, err := store.UpdateIf(ctx, id, func(n *models.Notification) bool {
+		if n.Status != models.StatusPending && n.Status != models.StatusRetrying {
+			return false
+		}
+		n.Status = models.StatusExpired
+		n.NextRetry = nil
+		slog.InfoContext(ctx, "Notification expired", logging.KeyNotificationID, n.ID, "expires_at", n.ExpiresAt)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	if expired != nil {
+		storage.RecordEvent(ctx, store, id, models.Event{
+			Type:  models.EventExpired,
+			Actor: actor,
+		})
+	}
+	return nil
+}
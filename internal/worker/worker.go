@@ -2,154 +2,530 @@ package worker
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/rabbitmq/amqp091-go"
-	"log"
-	"math"
+	"log/slog"
+	"sync"
 	"time"
 
-	"github.com/wb-go/wbf/retry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"notifier/internal/breaker"
+	"notifier/internal/logging"
+	"notifier/internal/metrics"
 	"notifier/internal/models"
 	"notifier/internal/queue"
+	"notifier/internal/ratelimit"
+	"notifier/internal/retrypolicy"
 	"notifier/internal/storage"
+	"notifier/internal/tenant"
+	"notifier/internal/tracing"
+	"notifier/internal/window"
+)
+
+// claimLease bounds how long a worker may hold a notification for one
+// attempt; the sweeper recovers notifications whose lease ran out.
+const claimLease = 2 * time.Minute
+
+var tracer = tracing.Tracer("notifier/worker")
+
+// Actors recorded in notification events by the worker's components.
+const (
+	actorWorker    = "worker"
+	actorScheduler = "scheduler"
+	actorSweeper   = "sweeper"
 )
 
 type Processor struct {
 	storage  storage.Storage
-	queue    *queue.Manager
-	stopChan chan struct{}
+	queue    queue.Queue
+	limiter  *ratelimit.Limiter
+	policies *retrypolicy.Registry
+	breakers *breaker.Registry
+
+	// mu guards draining, so that no message is admitted once Shutdown
+	// waits for the ones in flight.
+	mu            sync.Mutex
+	draining      bool
+	inFlight      sync.WaitGroup
+	stopConsuming context.CancelFunc
+	handlerCtx    context.Context
+	interrupt     context.CancelFunc
 }
 
-func NewProcessor(storage storage.Storage, queue *queue.Manager) *Processor {
+func NewProcessor(storage storage.Storage, queue queue.Queue, limiter *ratelimit.Limiter, policies *retrypolicy.Registry,
+	breakers *breaker.Registry) *Processor {
+	handlerCtx, interrupt := context.WithCancel(context.Background())
 	return &Processor{
-		storage:  storage,
-		queue:    queue,
-		stopChan: make(chan struct{}),
+		storage:    storage,
+		queue:      queue,
+		limiter:    limiter,
+		policies:   policies,
+		breakers:   breakers,
+		handlerCtx: handlerCtx,
+		interrupt:  interrupt,
 	}
 }
 
 func (p *Processor) Start(ctx context.Context) error {
-	err := p.queue.StartConsumer(ctx, p.handleMessage)
+	ctx, cancel := context.WithCancel(ctx)
+	err := p.queue.Consume(ctx, p.handleMessage)
 	if err != nil {
+		cancel()
 		return fmt.Errorf("failed to start consumer: %w", err)
 	}
+	p.stopConsuming = cancel
 
-	log.Println("Processor started successfully")
+	slog.Info("Processor started successfully")
 	return nil
 }
 
-func (p *Processor) Stop() {
-	close(p.stopChan)
-	log.Println("Processor stopped")
+// Shutdown stops consuming and waits for the messages being handled to
+// finish. Messages still being handled when ctx is done are interrupted:
+// their notification is handed back and the delivery is left to the queue
+// to nack, so it is redelivered after the restart.
+func (p *Processor) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.draining = true
+	p.mu.Unlock()
+	if p.stopConsuming != nil {
+		p.stopConsuming()
+	}
+	defer p.interrupt()
+
+	drained := make(chan struct{})
+	go func() {
+		p.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		slog.Info("Processor stopped")
+		return nil
+	case <-ctx.Done():
+		slog.Warn("Drain deadline passed, interrupting in-flight messages")
+		p.interrupt()
+		<-drained
+		return fmt.Errorf("failed to drain in-flight messages: %w", ctx.Err())
+	}
 }
 
-func (p *Processor) handleMessage(ctx context.Context, delivery amqp091.Delivery) error {
+// handleMessage continues the trace carried in the message headers, so the
+// attempt shows up in the trace of the request that created the
+// notification.
+func (p *Processor) handleMessage(ctx context.Context, msg *queue.Message) error {
+	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		return queue.ErrInterrupted
+	}
+	p.inFlight.Add(1)
+	p.mu.Unlock()
+	defer p.inFlight.Done()
+
+	// The consumer's context ends as soon as shutdown begins; a message being
+	// handled keeps going until Shutdown interrupts it.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(p.handlerCtx, cancel)
+	defer stop()
+
+	ctx = tracing.Extract(ctx, tracing.Headers(msg.Headers))
+	ctx = logging.WithRequestID(ctx, msg.RequestID())
+	ctx, span := tracer.Start(ctx, "worker.handleMessage", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+
+	start := time.Now()
+	err := p.process(ctx, msg)
+	if err != nil && p.handlerCtx.Err() != nil && !errors.Is(err, queue.ErrInterrupted) {
+		err = fmt.Errorf("%w: %v", queue.ErrInterrupted, err)
+	}
+
+	result := "ok"
+	var notReady *queue.NotReadyError
+	if errors.As(err, &notReady) {
+		result = "not_ready"
+	} else if errors.Is(err, queue.ErrInterrupted) {
+		result = "interrupted"
+	} else if err != nil {
+		result = "error"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(attribute.String("worker.result", result))
+	metrics.HandlerDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return err
+}
+
+func (p *Processor) process(ctx context.Context, msg *queue.Message) error {
 	var notification models.Notification
-	if err := json.Unmarshal(delivery.Body, &notification); err != nil {
-		log.Printf("Failed to unmarshal notification: %v", err)
-		return err
+	if err := json.Unmarshal(msg.Body, &notification); err != nil {
+		slog.ErrorContext(ctx, "Failed to unmarshal notification", logging.KeyError, err)
+		return fmt.Errorf("%w: %v", queue.ErrPoisonMessage, err)
 	}
 
-	log.Printf("Processing notification %s scheduled for %v",
-		notification.ID, notification.SendAt)
+	ctx = tenant.WithTenant(ctx, notification.TenantID)
+	ctx = logging.With(ctx,
+		slog.String(logging.KeyNotificationID, notification.ID),
+		slog.String(logging.KeyTenant, notification.TenantID),
+	)
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("notification.id", notification.ID),
+		attribute.String("tenant.id", notification.TenantID),
+		attribute.String("notification.channel", notification.Channel),
+	)
+
+	slog.DebugContext(ctx, "Processing notification", "due_at", notification.DueAt())
 
-	if notification.SendAt.After(time.Now()) {
-		log.Printf("Notification %s is not ready yet, will be requeued", notification.ID)
-		return fmt.Errorf("notification not ready")
+	if notification.DueAt().After(time.Now()) {
+		slog.InfoContext(ctx, "Notification is not ready yet, will be delayed")
+		return &queue.NotReadyError{Until: notification.DueAt()}
 	}
 
 	storedNotification, err := p.storage.GetByID(ctx, notification.ID)
 	if err != nil {
-		log.Printf("Error getting notification %s: %v", notification.ID, err)
+		slog.ErrorContext(ctx, "Error getting notification", logging.KeyError, err)
 		return err
 	}
 
 	if storedNotification == nil {
-		log.Printf("Notification %s not found", notification.ID)
+		slog.WarnContext(ctx, "Notification not found")
 		return nil
 	}
 
 	if storedNotification.Status == models.StatusCancelled {
-		log.Printf("Notification %s was cancelled", notification.ID)
+		slog.InfoContext(ctx, "Notification was cancelled")
 		return nil
 	}
 
-	if storedNotification.Attempts > 0 {
-		err = p.storage.Update(ctx, notification.ID, func(n *models.Notification) {
-			n.Status = models.StatusRetrying
-		})
-		if err != nil {
-			log.Printf("Failed to update notification %s: %v", notification.ID, err)
-		}
+	if storedNotification.Status == models.StatusExpired {
+		slog.InfoContext(ctx, "Notification has expired")
+		return nil
 	}
 
-	retryStrategy := retry.Strategy{
-		Attempts: storedNotification.MaxRetries - storedNotification.Attempts,
-		Delay:    1 * time.Second,
-		Backoff:  2,
+	if storedNotification.Expired(time.Now()) {
+		if err := expire(ctx, p.storage, notification.ID, actorWorker); err != nil {
+			slog.ErrorContext(ctx, "Failed to expire notification", logging.KeyError, err)
+			return err
+		}
+		return nil
 	}
 
-	var success bool
-	retryErr := retry.DoContext(ctx, retryStrategy, func() error {
-		success = p.sendNotification(storedNotification)
-		if !success {
-			return &SendError{Message: "Failed to send notification"}
-		}
+	claimed, err := p.claim(ctx, notification.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to claim notification", logging.KeyError, err)
+		return err
+	}
+	if claimed == nil {
+		slog.InfoContext(ctx, "Notification is claimed by another attempt or already settled")
 		return nil
+	}
+	attemptID := claimed.AttemptID
+	ctx = logging.With(ctx, slog.Int(logging.KeyAttempt, claimed.Attempts+1))
+
+	now := time.Now()
+	opensAt, err := window.Next(claimed.DeliveryWindow, now)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid delivery window", logging.KeyError, err)
+	} else if opensAt.After(now) {
+		slog.InfoContext(ctx, "Notification is outside its delivery window")
+		return p.deferNotification(ctx, claimed, opensAt, "outside delivery window")
+	}
+
+	// Checked before the rate limit so that a notification held back by an
+	// open breaker does not use up rate limit tokens.
+	destination := breaker.Key(claimed)
+	wait, err := p.breakers.Allow(ctx, destination)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking circuit breaker", logging.KeyError, err)
+		p.release(ctx, claimed)
+		return err
+	}
+	if wait > 0 {
+		slog.InfoContext(ctx, "Circuit breaker is open, notification deferred", "breaker", destination, "wait", wait)
+		return p.deferNotification(ctx, claimed, time.Now().Add(wait), "circuit breaker "+destination+" open")
+	}
+
+	wait, err = p.limiter.Reserve(ctx, claimed)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error checking rate limits", logging.KeyError, err)
+		p.release(ctx, claimed)
+		return err
+	}
+	if wait > 0 {
+		slog.InfoContext(ctx, "Notification is rate limited", "wait", wait)
+		return p.deferNotification(ctx, claimed, time.Now().Add(wait), "rate limited")
+	}
+
+	// One attempt per claim: failures are rescheduled through the queue
+	// rather than retried in place, so a consumer never sleeps on a backoff.
+	// The attempt only starts here: a claim deferred by the window, breaker or
+	// rate limit sends nothing.
+	storage.RecordEvent(ctx, p.storage, notification.ID, models.Event{
+		Type:      models.EventAttemptStarted,
+		Actor:     actorWorker,
+		Attempt:   claimed.Attempts + 1,
+		AttemptID: attemptID,
 	})
+	sendStart := time.Now()
+	sendErr := p.sendNotification(ctx, claimed)
+	metrics.SendDuration.WithLabelValues(claimed.Channel).Observe(time.Since(sendStart).Seconds())
+	if sendErr != nil && ctx.Err() != nil {
+		// Shutdown cut the attempt short, which says nothing about the
+		// destination: hand the notification back without counting it.
+		slog.WarnContext(ctx, "Attempt interrupted by shutdown", logging.KeyError, sendErr)
+		p.release(context.WithoutCancel(ctx), claimed)
+		return fmt.Errorf("%w: %v", queue.ErrInterrupted, sendErr)
+	}
+	policy := p.policies.For(claimed)
+
+	// A permanent error means the destination answered, so it does not count
+	// against the breaker.
+	var sendError *SendError
+	reachable := sendErr == nil || errors.As(sendErr, &sendError) && sendError.Permanent
+	if err := p.breakers.Record(ctx, destination, reachable); err != nil {
+		slog.ErrorContext(ctx, "Failed to record send result", logging.KeyError, err)
+	}
+
+	var failReason string
+	updated, err := p.storage.UpdateIf(ctx, notification.ID, func(n *models.Notification) bool {
+		if n.Status != models.StatusSending || n.AttemptID != attemptID {
+			return false
+		}
 
-	err = p.storage.Update(ctx, notification.ID, func(n *models.Notification) {
 		n.Attempts++
+		n.LeaseUntil = nil
+		n.NextRetry = nil
 
-		if success {
+		if sendErr == nil {
 			n.Status = models.StatusSent
-			n.NextRetry = nil
-			log.Printf("Notification %s sent successfully", notification.ID)
+			n.LastError = ""
+			slog.InfoContext(ctx, "Notification sent successfully")
+			return true
+		}
+		n.LastError = sendErr.Error()
+
+		delay := policy.Delay(n.Attempts, time.Duration(n.LastBackoffMs)*time.Millisecond)
+		if errors.As(sendErr, &sendError) && sendError.RetryAfter > delay {
+			delay = sendError.RetryAfter
+		}
+		nextRetry := time.Now().Add(delay)
+
+		switch {
+		case errors.As(sendErr, &sendError) && sendError.Permanent:
+			n.Status = models.StatusFailed
+			failReason = metrics.ReasonPermanent
+			slog.WarnContext(ctx, "Notification failed permanently", logging.KeyError, sendErr)
+		case n.Attempts >= n.MaxRetries:
+			n.Status = models.StatusFailed
+			failReason = metrics.ReasonMaxRetries
+			slog.WarnContext(ctx, "Notification failed after its last attempt", logging.KeyError, sendErr)
+		case policy.Exhausted(n, nextRetry):
+			n.Status = models.StatusFailed
+			failReason = metrics.ReasonPolicyExhausted
+			slog.WarnContext(ctx, "Notification failed, retry policy allows no further retry",
+				"policy", policy.Name, "next_retry", nextRetry, logging.KeyError, sendErr)
+		default:
+			n.Status = models.StatusRetrying
+			n.NextRetry = &nextRetry
+			n.EffectiveSendAt = &nextRetry
+			n.LastBackoffMs = delay.Milliseconds()
+			slog.InfoContext(ctx, "Notification failed, will retry",
+				"delay", delay, "policy", policy.Name, logging.KeyError, sendErr)
+		}
+		return true
+	})
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to update notification", logging.KeyError, err)
+		return err
+	}
+	if updated == nil {
+		slog.WarnContext(ctx, "Notification lost its lease, result discarded", "attempt_id", attemptID)
+		return nil
+	}
+	p.recordResult(ctx, updated, attemptID, sendErr)
+	observeResult(updated, failReason)
+
+	if updated.Status == models.StatusRetrying {
+		if err := p.queue.PublishDelayed(ctx, updated); err != nil {
+			// The notification stays retrying in the due index, so the
+			// scheduler republishes it once the retry is due.
+			slog.ErrorContext(ctx, "Failed to schedule retry, leaving it to the scheduler", logging.KeyError, err)
 		} else {
-			if n.Attempts >= n.MaxRetries || retryErr != nil {
-				n.Status = models.StatusFailed
-				n.NextRetry = nil
-				log.Printf("Notification %s failed after %d attempts: %v",
-					notification.ID, n.Attempts, retryErr)
-			} else {
-				delay := time.Duration(math.Pow(2, float64(n.Attempts))) * time.Second
-				nextRetry := time.Now().Add(delay)
-				n.NextRetry = &nextRetry
-				n.Status = models.StatusRetrying
-
-				n.SendAt = nextRetry
-				go func() {
-					if err := p.queue.PublishDelayed(ctx, n); err != nil {
-						log.Printf("Failed to schedule retry for notification %s: %v",
-							notification.ID, err)
-					}
-				}()
-
-				log.Printf("Notification %s failed, will retry in %v",
-					notification.ID, delay)
-			}
+			metrics.Published.WithLabelValues("retry").Inc()
+		}
+	}
+
+	return nil
+}
+
+// claim moves a due pending or retrying notification to sending under a new
+// attempt ID and lease. It returns nil if another worker holds the
+// notification, it was already settled, or this message is stale because the
+// notification was rescheduled.
+func (p *Processor) claim(ctx context.Context, id string) (*models.Notification, error) {
+	now := time.Now()
+	attemptID := newAttemptID()
+
+	return p.storage.UpdateIf(ctx, id, func(n *models.Notification) bool {
+		if n.Status != models.StatusPending && n.Status != models.StatusRetrying {
+			return false
+		}
+		if n.DueAt().After(now) {
+			return false
+		}
+
+		leaseUntil := now.Add(claimLease)
+		n.Status = models.StatusSending
+		n.AttemptID = attemptID
+		n.LeaseUntil = &leaseUntil
+		return true
+	})
+}
+
+// release hands a claimed notification back without counting an attempt,
+// so the queue's redelivery can claim it again.
+func (p *Processor) release(ctx context.Context, notification *models.Notification) {
+	_, err := p.storage.UpdateIf(ctx, notification.ID, func(n *models.Notification) bool {
+		if n.Status != models.StatusSending || n.AttemptID != notification.AttemptID {
+			return false
 		}
+		n.Status = models.StatusPending
+		n.LeaseUntil = nil
+		return true
 	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to release notification", logging.KeyError, err)
+	}
+}
 
+// recordResult adds the outcome of an attempt to the notification's history.
+func (p *Processor) recordResult(ctx context.Context, n *models.Notification, attemptID string, sendErr error) {
+	event := models.Event{
+		Type:      models.EventSent,
+		Actor:     actorWorker,
+		Attempt:   n.Attempts,
+		AttemptID: attemptID,
+	}
+	if sendErr == nil {
+		storage.RecordEvent(ctx, p.storage, n.ID, event)
+		return
+	}
+
+	event.Type = models.EventAttemptFailed
+	event.Error = sendErr.Error()
+	var sendError *SendError
+	if errors.As(sendErr, &sendError) {
+		event.Code = sendError.Code
+	}
+	if n.Status == models.StatusRetrying {
+		event.SendAt = n.NextRetry
+	}
+	storage.RecordEvent(ctx, p.storage, n.ID, event)
+
+	if n.Status == models.StatusFailed {
+		storage.RecordEvent(ctx, p.storage, n.ID, models.Event{
+			Type:    models.EventFailed,
+			Actor:   actorWorker,
+			Attempt: n.Attempts,
+		})
+	}
+}
+
+// observeResult counts the outcome of an attempt that was stored.
+func observeResult(n *models.Notification, failReason string) {
+	switch n.Status {
+	case models.StatusSent:
+		metrics.Attempts.WithLabelValues(n.Channel, "success").Inc()
+		metrics.Sent.WithLabelValues(n.Channel).Inc()
+		metrics.ScheduleLag.WithLabelValues(n.Channel).Observe(time.Since(n.DueAt()).Seconds())
+	case models.StatusFailed:
+		metrics.Attempts.WithLabelValues(n.Channel, "failure").Inc()
+		metrics.Failed.WithLabelValues(n.Channel, failReason).Inc()
+	default:
+		metrics.Attempts.WithLabelValues(n.Channel, "failure").Inc()
+	}
+}
+
+// deferNotification moves the notification to a later send time without
+// counting a delivery attempt.
+func (p *Processor) deferNotification(ctx context.Context, notification *models.Notification, until time.Time, reason string) error {
+	deferred, err := p.storage.UpdateIf(ctx, notification.ID, func(n *models.Notification) bool {
+		if n.Status != models.StatusSending || n.AttemptID != notification.AttemptID {
+			return false
+		}
+		n.EffectiveSendAt = &until
+		n.NextRetry = nil
+		n.LeaseUntil = nil
+		n.Status = models.StatusPending
+		return true
+	})
 	if err != nil {
-		log.Printf("Failed to update notification %s: %v", notification.ID, err)
+		slog.ErrorContext(ctx, "Failed to defer notification", logging.KeyError, err)
+		return err
+	}
+	if deferred == nil {
+		slog.WarnContext(ctx, "Notification lost its lease before it could be deferred")
+		return nil
+	}
+
+	if err := p.queue.PublishDelayed(ctx, deferred); err != nil {
+		slog.ErrorContext(ctx, "Failed to publish deferred notification", logging.KeyError, err)
 		return err
 	}
+	metrics.Published.WithLabelValues("deferred").Inc()
 
+	storage.RecordEvent(ctx, p.storage, notification.ID, models.Event{
+		Type:      models.EventScheduled,
+		Actor:     actorWorker,
+		AttemptID: notification.AttemptID,
+		SendAt:    &until,
+		Detail:    reason,
+	})
+
+	slog.InfoContext(ctx, "Notification deferred", "until", until, "reason", reason)
 	return nil
 }
 
-func (p *Processor) sendNotification(notification *models.Notification) bool {
+func (p *Processor) sendNotification(ctx context.Context, notification *models.Notification) (err error) {
+	_, span := tracer.Start(ctx, "send "+notification.Channel, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("notification.id", notification.ID),
+			attribute.String("notification.channel", notification.Channel),
+			attribute.Int("notification.attempt", notification.Attempts+1),
+		))
+	defer func() { tracing.End(span, err) }()
 
 	if notification.Attempts < 2 {
-		return true
+		return nil
+	}
+	return &SendError{Message: "Failed to send notification"}
+}
+
+func newAttemptID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
 	}
-	return false
+	return hex.EncodeToString(b)
 }
 
+// SendError describes a failed delivery. Permanent errors, such as a
+// rejected recipient, are not retried; RetryAfter is a minimum wait asked for
+// by the destination, e.g. from a 429 response. Code is the destination's
+// response code, such as an HTTP status or SMTP reply code, if it sent one.
 type SendError struct {
-	Message string
+	Message    string
+	Code       int
+	Permanent  bool
+	RetryAfter time.Duration
 }
 
 func (e *SendError) Error() string {
@@ -1,5 +1,11 @@
 const API_BASE_URL = window.location.origin + '/api';
 
+// Headers sent with every API request, including the tenant API key if set
+function apiHeaders(extra = {}) {
+    const apiKey = localStorage.getItem('apiKey');
+    return apiKey ? { ...extra, 'X-API-Key': apiKey } : extra;
+}
+
 // Set default datetime to 5 minutes from now
 function setDefaultDateTime() {
     const now = new Date();
@@ -21,7 +27,9 @@ function getStatusBadge(status) {
         'sent': { class: 'status-sent', text: 'Sent' },
         'failed': { class: 'status-failed', text: 'Failed' },
         'cancelled': { class: 'status-cancelled', text: 'Cancelled' },
-        'retrying': { class: 'status-retrying', text: 'Retrying' }
+        'retrying': { class: 'status-retrying', text: 'Retrying' },
+        'sending': { class: 'status-sending', text: 'Sending' },
+        'expired': { class: 'status-expired', text: 'Expired' }
     };
 
     const statusInfo = statusMap[status] || { class: 'status-pending', text: status };
@@ -32,22 +40,55 @@ function getStatusBadge(status) {
 async function createNotification(event) {
     event.preventDefault();
 
+    const channel = document.getElementById('channel').value;
+    const recipient = document.getElementById('recipient').value;
+    const priority = document.getElementById('priority').value;
     const message = document.getElementById('message').value;
     const sendAt = document.getElementById('sendAt').value;
     const maxRetries = document.getElementById('maxRetries').value || 3;
+    const maxDelay = document.getElementById('maxDelay').value;
+    const retryPolicy = document.getElementById('retryPolicy').value;
+    const callbackUrl = document.getElementById('callbackUrl').value;
+    const windowStart = document.getElementById('windowStart').value;
+    const windowEnd = document.getElementById('windowEnd').value;
+    const windowWeekdays = document.getElementById('windowWeekdays').checked;
 
     const notification = {
+        channel: channel,
+        recipient: recipient,
+        priority: priority,
         message: message,
         send_at: new Date(sendAt).toISOString(),
         max_retries: parseInt(maxRetries)
     };
 
+    if (maxDelay) {
+        notification.max_delay = maxDelay;
+    }
+
+    if (retryPolicy) {
+        notification.retry_policy = retryPolicy;
+    }
+
+    if (callbackUrl) {
+        notification.callback_url = callbackUrl;
+    }
+
+    if (windowStart && windowEnd) {
+        notification.delivery_window = {
+            start: windowStart,
+            end: windowEnd,
+            timezone: Intl.DateTimeFormat().resolvedOptions().timeZone,
+            days: windowWeekdays ? ['mon', 'tue', 'wed', 'thu', 'fri'] : []
+        };
+    }
+
     try {
         const response = await fetch(`${API_BASE_URL}/notify`, {
             method: 'POST',
-            headers: {
+            headers: apiHeaders({
                 'Content-Type': 'application/json'
-            },
+            }),
             body: JSON.stringify(notification)
         });
 
@@ -66,49 +107,165 @@ async function createNotification(event) {
     }
 }
 
+// Notifications currently shown, kept up to date by the change stream
+const notificationsById = new Map();
+
+// Rendered histories of the notifications whose history is expanded
+const openHistories = new Map();
+
+let changeStream = null;
+let statsTimer = null;
+
 // Load all notifications
 async function loadNotifications() {
     try {
-        const response = await fetch(`${API_BASE_URL}/notify`);
+        const response = await fetch(`${API_BASE_URL}/notify`, { headers: apiHeaders() });
         const notifications = await response.json();
 
-        const container = document.getElementById('notifications');
+        notificationsById.clear();
+        notifications.forEach(notification => notificationsById.set(notification.id, notification));
+        renderNotifications();
+    } catch (error) {
+        console.error('Error loading notifications:', error);
+        document.getElementById('notifications').innerHTML = '<p class="text-danger">Error loading notifications</p>';
+    }
+}
 
-        if (notifications.length === 0) {
-            container.innerHTML = '<p class="text-muted">No notifications yet.</p>';
-            return;
-        }
+function renderNotifications() {
+    const container = document.getElementById('notifications');
+    const notifications = [...notificationsById.values()];
+
+    if (notifications.length === 0) {
+        container.innerHTML = '<p class="text-muted">No notifications yet.</p>';
+        return;
+    }
 
-        let html = '<div class="list-group">';
+    let html = '<div class="list-group">';
 
-        notifications.sort((a, b) => new Date(b.created_at) - new Date(a.created_at)).forEach(notification => {
-            html += `
-                <div class="list-group-item notification-item">
-                    <div class="d-flex w-100 justify-content-between">
-                        <h6 class="mb-1">${notification.message}</h6>
-                        ${getStatusBadge(notification.status)}
-                    </div>
-                    <div class="d-flex justify-content-between align-items-center mt-2">
-                        <small class="text-muted">
-                            <strong>ID:</strong> ${notification.id}<br>
-                            <strong>Send at:</strong> ${formatDate(notification.send_at)}<br>
-                            <strong>Created:</strong> ${formatDate(notification.created_at)}<br>
-                            <strong>Attempts:</strong> ${notification.attempts}/${notification.max_retries}
-                        </small>
+    notifications.sort((a, b) => new Date(b.created_at) - new Date(a.created_at)).forEach(notification => {
+        html += `
+            <div class="list-group-item notification-item">
+                <div class="d-flex w-100 justify-content-between">
+                    <h6 class="mb-1">${notification.message}</h6>
+                    ${getStatusBadge(notification.status)}
+                </div>
+                <div class="d-flex justify-content-between align-items-center mt-2">
+                    <small class="text-muted">
+                        <strong>ID:</strong> ${notification.id}<br>
+                        <strong>Priority:</strong> ${notification.priority || 'normal'}<br>
+                        <strong>Channel:</strong> ${notification.channel}${notification.recipient ? ' → ' + notification.recipient : ''}<br>
+                        <strong>Send at:</strong> ${formatDate(notification.send_at)}<br>
+                        ${notification.effective_send_at ? `<strong>Effective send at:</strong> ${formatDate(notification.effective_send_at)}<br>` : ''}
+                        ${notification.expires_at ? `<strong>Expires:</strong> ${formatDate(notification.expires_at)}<br>` : ''}
+                        ${notification.delivery_window ? `<strong>Window:</strong> ${notification.delivery_window.start}–${notification.delivery_window.end} ${notification.delivery_window.timezone || 'UTC'}<br>` : ''}
+                        <strong>Created:</strong> ${formatDate(notification.created_at)}<br>
+                        <strong>Attempts:</strong> ${notification.attempts}/${notification.max_retries}${notification.retry_policy ? ` (${notification.retry_policy})` : ''}
+                        ${notification.last_error ? `<br><strong>Last error:</strong> ${notification.last_error}` : ''}
+                    </small>
+                    <div class="btn-group">
+                        <button onclick="toggleEvents('${notification.id}')" class="btn btn-sm btn-outline-secondary">History</button>
                         <button onclick="deleteNotification('${notification.id}')" class="btn btn-sm btn-danger">Delete</button>
                     </div>
                 </div>
-            `;
-        });
+                <div id="events-${notification.id}" class="notification-events mt-2" ${openHistories.has(notification.id) ? '' : 'hidden'}>${openHistories.get(notification.id) || ''}</div>
+            </div>
+        `;
+    });
 
-        html += '</div>';
-        container.innerHTML = html;
+    html += '</div>';
+    container.innerHTML = html;
+}
+
+// Show or hide the event history of a notification
+async function toggleEvents(id) {
+    const container = document.getElementById(`events-${id}`);
+    if (!container.hidden) {
+        container.hidden = true;
+        openHistories.delete(id);
+        return;
+    }
+
+    try {
+        await loadEvents(id);
     } catch (error) {
-        console.error('Error loading notifications:', error);
-        document.getElementById('notifications').innerHTML = '<p class="text-danger">Error loading notifications</p>';
+        alert(`Failed to load history: ${error.message}`);
     }
 }
 
+// Fetch and render the event history of a notification
+async function loadEvents(id) {
+    const response = await fetch(`${API_BASE_URL}/notify/${id}/events`, { headers: apiHeaders() });
+    if (!response.ok) {
+        throw new Error(await response.text());
+    }
+    const events = await response.json();
+
+    let html;
+    if (events.length === 0) {
+        html = '<small class="text-muted">No events recorded.</small>';
+    } else {
+        html = '<ul class="list-unstyled mb-0">' + events.map(event => `
+            <li>
+                <small>
+                    <span class="text-muted">${formatDate(event.at)}</span>
+                    <strong>${event.type.replace('_', ' ')}</strong>
+                    ${event.attempt ? `#${event.attempt}` : ''}
+                    by ${event.actor}
+                    ${event.send_at ? `→ ${formatDate(event.send_at)}` : ''}
+                    ${event.detail ? `(${event.detail})` : ''}
+                    ${event.error ? `<span class="text-danger">${event.code ? `[${event.code}] ` : ''}${event.error}</span>` : ''}
+                </small>
+            </li>
+        `).join('') + '</ul>';
+    }
+
+    openHistories.set(id, html);
+    const container = document.getElementById(`events-${id}`);
+    if (container) {
+        container.innerHTML = html;
+        container.hidden = false;
+    }
+}
+
+// Subscribe to live notification changes. The browser reconnects on its own;
+// every (re)connect reloads everything, since changes made while
+// disconnected are not replayed.
+function connectStream() {
+    if (changeStream) {
+        changeStream.close();
+    }
+
+    const apiKey = localStorage.getItem('apiKey');
+    const query = apiKey ? `?api_key=${encodeURIComponent(apiKey)}` : '';
+    changeStream = new EventSource(`${API_BASE_URL}/notify/stream${query}`);
+
+    changeStream.onopen = function() {
+        loadNotifications();
+        loadStats();
+    };
+
+    ['created', 'updated', 'status'].forEach(type => {
+        changeStream.addEventListener(type, function(event) {
+            const change = JSON.parse(event.data);
+            notificationsById.set(change.notification.id, change.notification);
+            renderNotifications();
+
+            if (openHistories.has(change.notification.id)) {
+                loadEvents(change.notification.id).catch(error => console.error('Error loading history:', error));
+            }
+            if (type !== 'updated') {
+                scheduleStatsRefresh();
+            }
+        });
+    });
+}
+
+// Reload statistics once a burst of changes has settled
+function scheduleStatsRefresh() {
+    clearTimeout(statsTimer);
+    statsTimer = setTimeout(loadStats, 500);
+}
+
 // Delete notification
 async function deleteNotification(id) {
     if (!confirm('Are you sure you want to delete this notification?')) {
@@ -117,7 +274,8 @@ async function deleteNotification(id) {
 
     try {
         const response = await fetch(`${API_BASE_URL}/notify/${id}`, {
-            method: 'DELETE'
+            method: 'DELETE',
+            headers: apiHeaders()
         });
 
         if (response.ok) {
@@ -134,7 +292,7 @@ async function deleteNotification(id) {
 // Load statistics
 async function loadStats() {
     try {
-        const response = await fetch(`${API_BASE_URL}/metrics`);
+        const response = await fetch(`${API_BASE_URL}/metrics`, { headers: apiHeaders() });
         const stats = await response.json();
 
         const statsContainer = document.getElementById('stats');
@@ -179,6 +337,14 @@ async function loadStats() {
                     </div>
                 </div>
             </div>
+            <div class="col-4 mb-2">
+                <div class="card text-center">
+                    <div class="card-body">
+                        <h4 class="card-title">${stats.expired || 0}</h4>
+                        <p class="card-text text-muted">Expired</p>
+                    </div>
+                </div>
+            </div>
         `;
     } catch (error) {
         console.error('Error loading stats:', error);
@@ -188,13 +354,14 @@ async function loadStats() {
 // Initialize
 document.addEventListener('DOMContentLoaded', function() {
     setDefaultDateTime();
+    const apiKeyInput = document.getElementById('apiKey');
+    apiKeyInput.value = localStorage.getItem('apiKey') || '';
+    apiKeyInput.addEventListener('change', function() {
+        localStorage.setItem('apiKey', apiKeyInput.value);
+        connectStream();
+    });
     document.getElementById('notificationForm').addEventListener('submit', createNotification);
     loadNotifications();
     loadStats();
-
-    // Auto-refresh every 10 seconds
-    setInterval(() => {
-        loadNotifications();
-        loadStats();
-    }, 10000);
+    connectStream();
 });
\ No newline at end of file